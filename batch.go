@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// skipError marks an input that was deliberately left alone, its message is the reason.
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+// skipFile returns an error that marks the input as skipped for the given reason.
+func skipFile(reason string) error {
+	return &skipError{reason: reason}
+}
+
+// isSkip reports whether err marks a skipped input.
+func isSkip(err error) bool {
+	return errors.As(err, new(*skipError))
+}
+
+// fileStatus is the outcome of processing one input.
+type fileStatus int
+
+const (
+	statusSucceeded fileStatus = iota
+	statusSkipped
+	statusFailed
+)
+
+// fileResult records what happened to one input of a batch.
+type fileResult struct {
+	input    string
+	output   string // Path written to, "-" for stdout, empty if nothing was written
+	status   fileStatus
+	err      error // Failure or skip reason
+	bytes    int64 // Bytes read from the input
+	duration time.Duration
+}
+
+// batchSummary holds the results of a batch in the order of the inputs.
+type batchSummary struct {
+	results  []fileResult
+	duration time.Duration
+}
+
+// runBatch processes the files with at most jobs workers and collects the result of every file.
+// process returns the output path it wrote and the bytes it read, or an error made with skipFile to skip the input.
+func runBatch(files []string, jobs int, process func(index int, filePath string) (string, int64, error)) *batchSummary {
+	startTime := time.Now()
+	summary := &batchSummary{results: make([]fileResult, len(files))}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < min(jobs, len(files)); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every index is handled by one worker, so the results need no locking
+			for index := range indexes {
+				fileStart := time.Now()
+				output, bytes, err := process(index, files[index])
+				result := fileResult{input: files[index], output: output, err: err, bytes: bytes, duration: time.Since(fileStart)}
+				switch {
+				case err == nil:
+					result.status = statusSucceeded
+				case isSkip(err):
+					result.status = statusSkipped
+					result.output = ""
+				default:
+					result.status = statusFailed
+					result.output = ""
+				}
+				summary.results[index] = result
+			}
+		}()
+	}
+
+	for index := range files {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	summary.duration = time.Since(startTime)
+	return summary
+}
+
+// count returns the number of inputs with the given status.
+func (s *batchSummary) count(status fileStatus) int {
+	n := 0
+	for _, result := range s.results {
+		if result.status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// message describes the batch for the user, verb being "encrypted" or "decrypted".
+// Failures are listed after the counts, one per line.
+func (s *batchSummary) message(verb string) string {
+	skipped, failed := s.count(statusSkipped), s.count(statusFailed)
+	if skipped == 0 && failed == 0 {
+		return fmt.Sprintf("All files %s successfully in: %s", verb, s.duration)
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "%d %s, %d skipped, %d failed in: %s", s.count(statusSucceeded), verb, skipped, failed, s.duration)
+	for _, result := range s.results {
+		if result.status == statusFailed {
+			fmt.Fprintf(&message, "\n%s: %v", result.input, result.err)
+		}
+	}
+	return message.String()
+}
+
+// report prints the summary and writes every result to the log.
+func (s *batchSummary) report(verb string) {
+	for _, result := range s.results {
+		switch result.status {
+		case statusSucceeded:
+			logger.Printf("%s %s to %s in %s", strings.ToUpper(verb[:1])+verb[1:], result.input, result.output, result.duration)
+		case statusSkipped:
+			logger.Printf("Skipped %s: %v", result.input, result.err)
+		case statusFailed:
+			logger.Printf("Failed %s: %v", result.input, result.err)
+		}
+	}
+
+	message := s.message(verb)
+	logger.Println(message)
+	if jsonReport {
+		s.writeJSON(statusOut)
+	} else {
+		fmt.Fprintln(statusOut, message)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
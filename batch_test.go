@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRunBatch tests that runBatch keeps the input order, respects the number of jobs and sorts the outcomes
+func TestRunBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		files int
+		jobs  int
+	}{
+		{"single job", 5, 1},
+		{"several jobs", 12, 3},
+		{"more jobs than files", 3, 8},
+		{"no files", 0, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := make([]string, test.files)
+			for i := range files {
+				files[i] = fmt.Sprintf("file%d.txt", i)
+			}
+
+			var running, peak atomic.Int32
+			summary := runBatch(files, test.jobs, func(index int, filePath string) (string, int64, error) {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+
+				// Later inputs finish first, so the results only come back in order if runBatch puts them there
+				time.Sleep(time.Duration(len(files)-index) * time.Millisecond)
+				switch index % 3 {
+				case 1:
+					return "", 0, skipFile("already encrypted")
+				case 2:
+					return "", int64(index), errors.New("failed")
+				default:
+					return filePath + ".enc", int64(index), nil
+				}
+			})
+
+			if len(summary.results) != len(files) {
+				t.Fatalf("Expected %d results, got %d", len(files), len(summary.results))
+			}
+			if limit := int32(min(test.jobs, len(files))); peak.Load() > limit {
+				t.Errorf("Expected at most %d files at once, got %d", limit, peak.Load())
+			}
+
+			for i, result := range summary.results {
+				if result.input != files[i] {
+					t.Errorf("Result %d: expected input %s, got %s", i, files[i], result.input)
+				}
+				want := []fileStatus{statusSucceeded, statusSkipped, statusFailed}[i%3]
+				if result.status != want {
+					t.Errorf("Result %d: expected status %d, got %d: %v", i, want, result.status, result.err)
+				}
+				if want == statusSucceeded && result.output != files[i]+".enc" {
+					t.Errorf("Result %d: expected output %s, got %q", i, files[i]+".enc", result.output)
+				}
+				if want != statusSucceeded && result.output != "" {
+					t.Errorf("Result %d: expected no output, got %q", i, result.output)
+				}
+			}
+
+			skipped := (len(files) + 1) / 3
+			if got := summary.count(statusSkipped); got != skipped {
+				t.Errorf("Expected %d skipped, got %d", skipped, got)
+			}
+			if got := summary.count(statusFailed); got != len(files)/3 {
+				t.Errorf("Expected %d failed, got %d", len(files)/3, got)
+			}
+		})
+	}
+}
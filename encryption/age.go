@@ -0,0 +1,402 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Files in the age v1 format (https://age-encryption.org/v1) start with a text header listing a stanza
+// for every recipient, each holding the 16 byte file key wrapped for it, and end the header with an
+// HMAC over it. The payload follows as a 16 byte nonce and STREAM chunks of 64KiB sealed with
+// ChaCha20-Poly1305. Its nonce is an 11 byte chunk counter and the last-chunk flag, which is the same
+// as our stream nonce with a prefix of zero bytes.
+const (
+	ageVersionLine   = "age-encryption.org/v1"
+	ageChunkSize     = 64 * 1024
+	ageFileKeySize   = 16
+	ageNonceSize     = 16
+	ageColumns       = 64 // Base64 characters per line of a stanza body
+	ageScryptLabel   = "age-encryption.org/v1/scrypt"
+	ageX25519Label   = "age-encryption.org/v1/X25519"
+	ageScryptSalt    = 16
+	ageMaxWorkFactor = 22 // Highest scrypt work factor accepted when decrypting, as in age
+)
+
+// ageWorkFactor is the scrypt work factor (log2 of N) of new password protected age files.
+var ageWorkFactor = 18
+
+// ageNoncePrefix turns our stream nonce into age's 11 byte counter.
+var ageNoncePrefix = make([]byte, chacha20poly1305.NonceSize-streamSuffixSize)
+
+// ageBase64 is the unpadded, canonical base64 encoding used in age headers.
+var ageBase64 = base64.RawStdEncoding.Strict()
+
+// ageStanza is one recipient stanza of an age header.
+type ageStanza struct {
+	kind string
+	args []string
+	body []byte
+}
+
+// ageHeader is the parsed text header of an age file.
+type ageHeader struct {
+	stanzas []ageStanza
+	signed  []byte // The header up to and including "---", covered by mac
+	mac     []byte
+	size    int // Length of the header, including the MAC line
+}
+
+// newAgeWriter writes the header of an age file to dest and returns a writer that encrypts the payload.
+// The file key is wrapped for opts.Recipients, or with the password through scrypt if there are none.
+func newAgeWriter(dest io.Writer, password string, opts Options) (io.WriteCloser, error) {
+	if opts.Keyfile != nil {
+		return nil, fmt.Errorf("age files cannot require a keyfile")
+	}
+	if opts.RecoveryCode != "" {
+		return nil, fmt.Errorf("age files cannot have a recovery code")
+	}
+	if password == "" && len(opts.Recipients) == 0 {
+		return nil, fmt.Errorf("age files need a password or recipients")
+	}
+
+	fileKey := make([]byte, ageFileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %v", err)
+	}
+	var stanzas []ageStanza
+	for _, recipient := range opts.Recipients {
+		stanza, err := recipient.wrapAge(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+	if len(stanzas) == 0 {
+		stanza, err := wrapAgeScrypt(fileKey, password, ageWorkFactor)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	header, err := marshalAgeHeader(stanzas, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, ageNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := newStreamWriter(dest, aead, ageNoncePrefix, ageChunkSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Workers > 1 {
+		writer.setWorkers(opts.Workers)
+	}
+	if _, err := dest.Write(append(header, nonce...)); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+	return writer, nil
+}
+
+// newAgeReader reads the header of an age file from source and returns a reader for the payload.
+func newAgeReader(source io.Reader, s secrets, workers int) (io.Reader, error) {
+	buffered := bufio.NewReader(source)
+	_, aead, err := openAgeHeader(buffered, s)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newStreamReader(buffered, aead, ageNoncePrefix, ageChunkSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	if workers > 1 {
+		reader.setWorkers(workers)
+	}
+	return reader, nil
+}
+
+// newAgeReaderAt opens the payload of an age file of the given size for random access.
+func newAgeReaderAt(source io.ReaderAt, size int64, s secrets) (*chunkReaderAt, error) {
+	header, aead, err := openAgeHeader(bufio.NewReader(io.NewSectionReader(source, 0, size)), s)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(header.size + ageNonceSize)
+	return newChunkReaderAt(io.NewSectionReader(source, offset, size-offset), size-offset, aead, ageNoncePrefix, ageChunkSize, nil, 1, false)
+}
+
+// openAgeHeader reads the header and the payload nonce, unwraps the file key with the secrets and
+// checks the header MAC. It returns the header and the AEAD of the payload.
+func openAgeHeader(source *bufio.Reader, s secrets) (*ageHeader, cipher.AEAD, error) {
+	header, err := readAgeHeader(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, ageNonceSize)
+	if _, err := io.ReadFull(source, nonce); err != nil {
+		return nil, nil, readError("payload nonce", err)
+	}
+
+	fileKey, err := header.fileKey(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	mac, err := ageHeaderMAC(fileKey, header.signed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal(mac, header.mac) {
+		return nil, nil, fmt.Errorf("%w: header MAC does not match", ErrCorrupted)
+	}
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// readAgeHeader parses the text header, leaving source at the payload nonce.
+func readAgeHeader(source *bufio.Reader) (*ageHeader, error) {
+	var raw bytes.Buffer
+	readLine := func(what string) (string, error) {
+		line, err := source.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return "", fmt.Errorf("%w: %s is too long", ErrCorrupted, what)
+		}
+		if err != nil {
+			return "", readError(what, err)
+		}
+		raw.Write(line)
+		return string(line[:len(line)-1]), nil
+	}
+
+	version, err := readLine("age header")
+	if err != nil {
+		return nil, err
+	}
+	if version != ageVersionLine {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedVersion, version)
+	}
+
+	header := &ageHeader{}
+	for {
+		line, err := readLine("age header")
+		if err != nil {
+			return nil, err
+		}
+
+		// The header ends with the MAC line, which signs everything before the space
+		if mac, found := strings.CutPrefix(line, "--- "); found {
+			if header.mac, err = ageBase64.DecodeString(mac); err != nil || len(header.mac) != sha256.Size {
+				return nil, fmt.Errorf("%w: invalid header MAC", ErrCorrupted)
+			}
+			header.size = raw.Len()
+			header.signed = raw.Bytes()[:raw.Len()-len(mac)-2]
+			break
+		}
+
+		args, found := strings.CutPrefix(line, "-> ")
+		if !found {
+			return nil, fmt.Errorf("%w: invalid stanza line %q", ErrCorrupted, line)
+		}
+		// Arguments are non-empty and made of printable ASCII characters other than space
+		fields := strings.Split(args, " ")
+		for _, field := range fields {
+			if field == "" || strings.IndexFunc(field, func(r rune) bool { return r < 0x21 || r > 0x7e }) >= 0 {
+				return nil, fmt.Errorf("%w: invalid stanza line %q", ErrCorrupted, line)
+			}
+		}
+		stanza := ageStanza{kind: fields[0], args: fields[1:]}
+
+		// The body is wrapped at 64 columns and ends with a shorter line, which may be empty
+		for {
+			line, err := readLine("age stanza")
+			if err != nil {
+				return nil, err
+			}
+			chunk, err := ageBase64.DecodeString(line)
+			if err != nil || len(line) > ageColumns {
+				return nil, fmt.Errorf("%w: invalid stanza body", ErrCorrupted)
+			}
+			stanza.body = append(stanza.body, chunk...)
+			if len(line) < ageColumns {
+				break
+			}
+		}
+		header.stanzas = append(header.stanzas, stanza)
+	}
+
+	if len(header.stanzas) == 0 {
+		return nil, fmt.Errorf("%w: no stanzas", ErrCorrupted)
+	}
+	return header, nil
+}
+
+// fileKey unwraps the file key, with the password if the file was encrypted with one and with the
+// identities otherwise. Stanzas of unknown types are skipped.
+func (h *ageHeader) fileKey(s secrets) ([]byte, error) {
+	for _, stanza := range h.stanzas {
+		if stanza.kind == "scrypt" && len(h.stanzas) != 1 {
+			return nil, fmt.Errorf("%w: a scrypt stanza must be the only one", ErrCorrupted)
+		}
+	}
+	if h.stanzas[0].kind == "scrypt" {
+		return unwrapAgeScrypt(h.stanzas[0], s.password)
+	}
+
+	if len(s.identities) == 0 {
+		return nil, ErrIdentityRequired
+	}
+	for _, stanza := range h.stanzas {
+		if stanza.kind != "X25519" {
+			continue
+		}
+		if len(stanza.args) != 1 || len(stanza.body) != ageFileKeySize+chacha20poly1305.Overhead {
+			return nil, fmt.Errorf("%w: invalid X25519 stanza", ErrCorrupted)
+		}
+		share, err := ageBase64.DecodeString(stanza.args[0])
+		if err != nil || len(share) != curve25519.PointSize {
+			return nil, fmt.Errorf("%w: invalid X25519 stanza", ErrCorrupted)
+		}
+		for _, identity := range s.identities {
+			fileKey, err := identity.open(share, stanza.body, nil, ageX25519Label)
+			if err == nil {
+				return fileKey, nil
+			}
+			if err != errStanzaMismatch {
+				return nil, err
+			}
+		}
+	}
+	return nil, ErrNoMatchingIdentity
+}
+
+// wrapAge wraps the file key for the recipient in an age X25519 stanza.
+func (r *X25519Recipient) wrapAge(fileKey []byte) (ageStanza, error) {
+	share, shared, err := r.agree()
+	if err != nil {
+		return ageStanza{}, err
+	}
+	aead, err := x25519WrapAEAD(shared, share, r.publicKey, ageX25519Label)
+	if err != nil {
+		return ageStanza{}, err
+	}
+	body := aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil)
+	return ageStanza{kind: "X25519", args: []string{ageBase64.EncodeToString(share)}, body: body}, nil
+}
+
+// wrapAgeScrypt wraps the file key with a key derived from the password in an age scrypt stanza.
+func wrapAgeScrypt(fileKey []byte, password string, workFactor int) (ageStanza, error) {
+	salt := make([]byte, ageScryptSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return ageStanza{}, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	aead, err := ageScryptAEAD(password, salt, workFactor)
+	if err != nil {
+		return ageStanza{}, err
+	}
+	body := aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil)
+	args := []string{ageBase64.EncodeToString(salt), strconv.Itoa(workFactor)}
+	return ageStanza{kind: "scrypt", args: args, body: body}, nil
+}
+
+// unwrapAgeScrypt recovers the file key from a scrypt stanza.
+func unwrapAgeScrypt(stanza ageStanza, password string) ([]byte, error) {
+	if len(stanza.args) != 2 || len(stanza.body) != ageFileKeySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("%w: invalid scrypt stanza", ErrCorrupted)
+	}
+	salt, err := ageBase64.DecodeString(stanza.args[0])
+	if err != nil || len(salt) != ageScryptSalt {
+		return nil, fmt.Errorf("%w: invalid scrypt salt", ErrCorrupted)
+	}
+	workFactor, err := strconv.Atoi(stanza.args[1])
+	if err != nil || workFactor <= 0 || strconv.Itoa(workFactor) != stanza.args[1] {
+		return nil, fmt.Errorf("%w: invalid scrypt work factor", ErrCorrupted)
+	}
+	if workFactor > ageMaxWorkFactor {
+		return nil, fmt.Errorf("scrypt work factor %d is too high (at most %d)", workFactor, ageMaxWorkFactor)
+	}
+
+	aead, err := ageScryptAEAD(password, salt, workFactor)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), stanza.body, nil)
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+	return fileKey, nil
+}
+
+// ageScryptAEAD derives the key that wraps the file key from the password with scrypt.
+func ageScryptAEAD(password string, salt []byte, workFactor int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(password), append([]byte(ageScryptLabel), salt...), 1<<workFactor, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// marshalAgeHeader encodes the stanzas and signs them with the MAC key derived from the file key.
+func marshalAgeHeader(stanzas []ageStanza, fileKey []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(ageVersionLine + "\n")
+	for _, stanza := range stanzas {
+		buf.WriteString("-> " + strings.Join(append([]string{stanza.kind}, stanza.args...), " ") + "\n")
+		body := ageBase64.EncodeToString(stanza.body)
+		for len(body) >= ageColumns {
+			buf.WriteString(body[:ageColumns] + "\n")
+			body = body[ageColumns:]
+		}
+		buf.WriteString(body + "\n")
+	}
+	buf.WriteString("---")
+
+	mac, err := ageHeaderMAC(fileKey, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(" " + ageBase64.EncodeToString(mac) + "\n")
+	return buf.Bytes(), nil
+}
+
+// ageHeaderMAC computes the HMAC-SHA256 of the header with a key derived from the file key.
+func ageHeaderMAC(fileKey, header []byte) ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fileKey, nil, []byte("header")), key); err != nil {
+		return nil, fmt.Errorf("failed to derive header key: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	return mac.Sum(nil), nil
+}
+
+// agePayloadAEAD derives the payload key from the file key and the payload nonce.
+func agePayloadAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fileKey, nonce, []byte("payload")), key); err != nil {
+		return nil, fmt.Errorf("failed to derive payload key: %v", err)
+	}
+	return chacha20poly1305.New(key)
+}
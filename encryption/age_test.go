@@ -0,0 +1,359 @@
+package encryption
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ageTestOptions returns options that write an age file to the recipients, and lowers the scrypt
+// work factor of password files for the rest of the test
+func ageTestOptions(t *testing.T, workers int, recipients ...*X25519Recipient) Options {
+	workFactor := ageWorkFactor
+	t.Cleanup(func() { ageWorkFactor = workFactor })
+	ageWorkFactor = 10
+
+	opts := testOptions(1)
+	opts.Format = FormatAge
+	opts.Recipients = recipients
+	opts.Workers = workers
+	return opts
+}
+
+// TestAgeKeys tests the key encoding against the test identity of age's test suite
+func TestAgeKeys(t *testing.T) {
+	identity, err := ParseX25519Identity("AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX")
+	if err != nil {
+		t.Fatalf("Failed to parse identity: %v", err)
+	}
+	if recipient := identity.Recipient().String(); recipient != "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj" {
+		t.Errorf("Unexpected recipient: %s", recipient)
+	}
+}
+
+// TestAgePassword tests age files encrypted with a password, on and off chunk boundaries
+func TestAgePassword(t *testing.T) {
+	key := "testpassword"
+	for _, size := range []int{0, 1, ageChunkSize, 2*ageChunkSize + 5} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		for _, workers := range []int{1, 4} {
+			ciphertext := encryptTestData(t, key, plaintext, ageTestOptions(t, workers))
+			if !bytes.HasPrefix(ciphertext, []byte(ageVersionLine+"\n-> scrypt ")) {
+				t.Fatalf("Unexpected header: %q", ciphertext[:40])
+			}
+			if format, err := DetectFormat(bytes.NewReader(ciphertext)); format != FormatAge || err != nil {
+				t.Errorf("Expected FormatAge, got %v: %v", format, err)
+			}
+
+			decrypted, err := decryptTestData(ciphertext, key, DecryptOptions{Workers: 2})
+			if err != nil || !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("%d bytes, %d workers: decryption failed: %v", size, workers, err)
+			}
+		}
+	}
+
+	ciphertext := encryptTestData(t, key, []byte("secret"), ageTestOptions(t, 1))
+	if _, err := decryptTestData(ciphertext, "otherpassword", DecryptOptions{Workers: 2}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+}
+
+// TestAgeRecipients tests age files encrypted to recipients, including unknown stanzas and random access
+func TestAgeRecipients(t *testing.T) {
+	var identities []*X25519Identity
+	for i := 0; i < 3; i++ {
+		identity, err := GenerateX25519Identity()
+		if err != nil {
+			t.Fatalf("Failed to generate identity: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+	plaintext := make([]byte, 3*ageChunkSize+100)
+	rand.Read(plaintext)
+	ciphertext := encryptTestData(t, "", plaintext, ageTestOptions(t, 1, identities[0].Recipient(), identities[1].Recipient()))
+
+	for i, identity := range identities[:2] {
+		decrypted, err := decryptTestData(ciphertext, "", DecryptOptions{Identities: []*X25519Identity{identity}, Workers: 2})
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Recipient %d: decryption failed: %v", i+1, err)
+		}
+	}
+	if _, err := decryptTestData(ciphertext, "", DecryptOptions{Identities: []*X25519Identity{identities[2]}, Workers: 2}); !errors.Is(err, ErrNoMatchingIdentity) {
+		t.Errorf("Expected ErrNoMatchingIdentity, got %v", err)
+	}
+	if _, err := decryptTestData(ciphertext, "", DecryptOptions{Workers: 2}); !errors.Is(err, ErrIdentityRequired) {
+		t.Errorf("Expected ErrIdentityRequired, got %v", err)
+	}
+
+	reader, err := NewDecryptReaderAtWithOptions(bytes.NewReader(ciphertext), int64(len(ciphertext)), "", DecryptOptions{Identities: identities[1:2]})
+	if err != nil {
+		t.Fatalf("Failed to open for random access: %v", err)
+	}
+	part := make([]byte, 200)
+	if _, err := reader.ReadAt(part, 2*ageChunkSize-100); err != nil || !bytes.Equal(part, plaintext[2*ageChunkSize-100:2*ageChunkSize+100]) {
+		t.Errorf("Random access read failed: %v", err)
+	}
+
+	// Stanzas of unknown types are skipped, and long bodies are wrapped over several lines
+	fileKey := make([]byte, ageFileKeySize)
+	rand.Read(fileKey)
+	stanza, err := identities[2].Recipient().wrapAge(fileKey)
+	if err != nil {
+		t.Fatalf("Failed to wrap file key: %v", err)
+	}
+	grease := ageStanza{kind: "grease-test", args: []string{"a", "b"}, body: make([]byte, 2*48)}
+	header, err := marshalAgeHeader([]ageStanza{grease, stanza}, fileKey)
+	if err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	if !strings.Contains(string(header), "\n-> grease-test a b\n"+strings.Repeat("A", ageColumns)+"\n"+strings.Repeat("A", ageColumns)+"\n\n") {
+		t.Errorf("Unexpected body wrapping: %q", header)
+	}
+	nonce := make([]byte, ageNonceSize)
+	aead, _ := agePayloadAEAD(fileKey, nonce)
+	var payload bytes.Buffer
+	if err := sealStream(aead, ageNoncePrefix, ageChunkSize, nil, bytes.NewReader(plaintext), &payload); err != nil {
+		t.Fatalf("Failed to seal payload: %v", err)
+	}
+	decrypted, err := decryptTestData(append(append(header, nonce...), payload.Bytes()...), "", DecryptOptions{Identities: []*X25519Identity{identities[2]}, Workers: 2})
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decryption with an unknown stanza failed: %v", err)
+	}
+}
+
+// TestAgeErrors tests that damaged age files are reported like our own
+func TestAgeErrors(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 2*ageChunkSize+100)
+	rand.Read(plaintext)
+	ciphertext := encryptTestData(t, key, plaintext, ageTestOptions(t, 1))
+	headerSize := bytes.Index(ciphertext, []byte("\n---")) + len("\n--- \n") + 43 // Up to the end of the MAC line
+	sealedChunk := ageChunkSize + 16
+
+	macChanged := bytes.Clone(ciphertext)
+	macChanged[headerSize-2] ^= 0x01
+	workFactorChanged := bytes.Replace(ciphertext, []byte(" 10\n"), []byte(" 23\n"), 1)
+	chunkChanged := bytes.Clone(ciphertext)
+	chunkChanged[headerSize+ageNonceSize+sealedChunk+10] ^= 0x01
+	twoStanzas := bytes.Replace(ciphertext, []byte("\n---"), []byte("\n-> X25519 abc\nabc\n---"), 1)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"changed MAC", macChanged, ErrCorrupted},
+		{"changed chunk", chunkChanged, ErrCorrupted},
+		{"scrypt next to another stanza", twoStanzas, ErrCorrupted},
+		{"truncated header", ciphertext[:headerSize-10], ErrTruncated},
+		{"truncated on a chunk boundary", ciphertext[:headerSize+ageNonceSize+sealedChunk], ErrTruncated},
+		{"data after the final chunk", append(bytes.Clone(ciphertext), make([]byte, 100)...), ErrCorrupted},
+	}
+	for _, test := range tests {
+		if _, err := decryptTestData(test.data, key, DecryptOptions{Workers: 2}); !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+	if _, err := decryptTestData(workFactorChanged, key, DecryptOptions{Workers: 2}); err == nil || !strings.Contains(err.Error(), "too high") {
+		t.Errorf("Expected a work factor above the limit to be refused, got %v", err)
+	}
+}
+
+// TestAgeInterop decrypts files written by the age v1.2.1 command line tool, see testdata/age
+func TestAgeInterop(t *testing.T) {
+	plaintext := []byte("Interoperability test vector written by the age v1.2.1 command line tool.\n")
+	identities, err := ReadIdentities(filepath.Join("testdata", "age", "cli_identity.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read identity: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		opts     DecryptOptions
+	}{
+		{"cli_x25519.age", "", DecryptOptions{Identities: identities}},
+		{"cli_scrypt.age", "correct horse battery staple", DecryptOptions{}},
+	}
+	for _, test := range tests {
+		decrypted, err := decryptTestData(readTestFile(t, filepath.Join("testdata", "age", test.name)), test.password, test.opts)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s: decryption failed: %v", test.name, err)
+		}
+	}
+}
+
+// countingRand is a source of randomness that returns the bytes 0, 1, 2, ... wrapping at 256.
+type countingRand struct {
+	next byte
+}
+
+func (r *countingRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.next
+		r.next++
+	}
+	return len(p), nil
+}
+
+// TestAgeKnownAnswer tests that with the same randomness our age files are byte for byte the ones the
+// age v1.2.1 library writes, see testdata/age/kat_*.age
+func TestAgeKnownAnswer(t *testing.T) {
+	plaintext := []byte("Known answer test written by the age v1.2.1 library.\n")
+	recipient, err := ParseX25519Recipient("age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj")
+	if err != nil {
+		t.Fatalf("Failed to parse recipient: %v", err)
+	}
+	reader := rand.Reader
+	t.Cleanup(func() { rand.Reader = reader })
+
+	tests := []struct {
+		name     string
+		password string
+		opts     Options
+	}{
+		{"kat_x25519.age", "", ageTestOptions(t, 1, recipient)},
+		{"kat_scrypt.age", "password", ageTestOptions(t, 1)},
+	}
+	for _, test := range tests {
+		rand.Reader = &countingRand{}
+		ciphertext := encryptTestData(t, test.password, plaintext, test.opts)
+		if expected := readTestFile(t, filepath.Join("testdata", "age", test.name)); !bytes.Equal(ciphertext, expected) {
+			t.Errorf("%s: expected\n%q\ngot\n%q", test.name, expected, ciphertext)
+		}
+	}
+}
+
+// testkitVector is a test vector of the age test suite, see testdata/testkit.
+type testkitVector struct {
+	expect      string
+	payload     string // Hex SHA-256 of the plaintext released before success or failure
+	identities  []*X25519Identity
+	passphrases []string
+	file        []byte
+}
+
+// readTestkitVector parses the key-value lines and the age file of a test vector
+func readTestkitVector(t *testing.T, path string) testkitVector {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read vector: %v", err)
+	}
+	var vector testkitVector
+	compressed := false
+	for {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			t.Fatalf("Vector ends in its header")
+		}
+		data = rest
+		if len(line) == 0 {
+			break
+		}
+		key, value, _ := strings.Cut(string(line), ": ")
+		switch key {
+		case "expect":
+			vector.expect = value
+		case "payload":
+			vector.payload = value
+		case "passphrase":
+			vector.passphrases = append(vector.passphrases, value)
+		case "compressed":
+			compressed = value == "zlib"
+		case "identity":
+			identity, err := ParseX25519Identity(value)
+			if err != nil {
+				t.Fatalf("Failed to parse identity: %v", err)
+			}
+			vector.identities = append(vector.identities, identity)
+		}
+	}
+
+	vector.file = data
+	if compressed {
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to decompress vector: %v", err)
+		}
+		if vector.file, err = io.ReadAll(reader); err != nil {
+			t.Fatalf("Failed to decompress vector: %v", err)
+		}
+	}
+	return vector
+}
+
+// TestAgeTestkit decrypts the vectors of the age test suite (https://github.com/C2SP/CCTV/tree/main/age)
+// that do not use the ASCII armor or post-quantum recipients, which this implementation does not read
+func TestAgeTestkit(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "testkit", "*"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No test vectors found: %v", err)
+	}
+	for _, path := range paths {
+		if filepath.Base(path) == "README.md" {
+			continue
+		}
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			vector := readTestkitVector(t, path)
+			// Only one password can be tried, files with several scrypt stanzas are refused anyway
+			password := ""
+			if len(vector.passphrases) > 0 {
+				password = vector.passphrases[0]
+			}
+
+			for _, workers := range []int{1, 4} {
+				decrypted, err := decryptTestData(vector.file, password, DecryptOptions{Identities: vector.identities, Workers: workers})
+				checkTestkitResult(t, vector, decrypted, err, workers)
+			}
+		})
+	}
+}
+
+// checkTestkitResult checks the outcome of decrypting a test vector with the given number of workers
+func checkTestkitResult(t *testing.T, vector testkitVector, decrypted []byte, err error, workers int) {
+	t.Helper()
+	switch vector.expect {
+	case "success":
+		if err != nil {
+			t.Errorf("%d workers: decryption failed: %v", workers, err)
+			return
+		}
+	case "no match":
+		// A password for a file without a scrypt stanza asks for an identity instead
+		if !errors.Is(err, ErrNoMatchingIdentity) && !errors.Is(err, ErrWrongPassword) && !errors.Is(err, ErrIdentityRequired) {
+			t.Errorf("%d workers: expected no match, got %v", workers, err)
+		}
+		return
+	case "HMAC failure":
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%d workers: expected ErrCorrupted, got %v", workers, err)
+		}
+		return
+	case "header failure":
+		if err == nil {
+			t.Errorf("%d workers: expected the header to be refused", workers)
+		}
+		return
+	case "payload failure":
+		if !errors.Is(err, ErrCorrupted) && !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d workers: expected ErrCorrupted or ErrTruncated, got %v", workers, err)
+		}
+	default:
+		t.Fatalf("Unknown expectation %q", vector.expect)
+	}
+
+	// The plaintext released before the end or the error must match
+	if sum := sha256.Sum256(decrypted); hex.EncodeToString(sum[:]) != vector.payload {
+		t.Errorf("%d workers: plaintext of %d bytes does not match the payload hash", workers, len(decrypted))
+	}
+}
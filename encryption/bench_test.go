@@ -0,0 +1,168 @@
+package encryption
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// benchmarkHeader builds a header for the given version with the default KDF parameters
+func benchmarkHeader(b *testing.B, version byte, layers int) *fileHeader {
+	header := version3Header(b, DefaultOptions(layers))
+	if version == 2 {
+		// Version 2 headers carry a salt for every layer instead of one for the file
+		header.version = 2
+		header.salt = nil
+		for i := range header.layers {
+			header.layers[i].salt, _ = GenerateSalt()
+		}
+	}
+	return header
+}
+
+// BenchmarkLayerKeys compares running the KDF for every layer (version 2) with running it
+// once and expanding the layer keys with HKDF (version 3).
+func BenchmarkLayerKeys(b *testing.B) {
+	for _, layers := range []int{1, 5, 20} {
+		for _, version := range []byte{2, 3} {
+			header := benchmarkHeader(b, version, layers)
+			b.Run(fmt.Sprintf("v%d/layers=%d", version, layers), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := header.layerKeys(secrets{password: "testpassword"}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// benchmarkChunkSizes are the chunk sizes compared by the throughput benchmarks
+var benchmarkChunkSizes = []int{4 * 1024, 32 * 1024, 256 * 1024, 1024 * 1024, 4 * 1024 * 1024}
+
+// benchmarkPayload is the amount of plaintext encrypted per iteration
+const benchmarkPayload = 16 * 1024 * 1024
+
+// benchmarkKeys builds a header with the given chunk size and derives its keys once,
+// so the benchmarks measure the chunk processing and not the KDF
+func benchmarkKeys(b *testing.B, size, layers int) (*fileHeader, [][]byte) {
+	opts := DefaultOptions(layers)
+	opts.KDF = KDFParams{Time: 1, Memory: minKDFMemory, Threads: 1}
+	opts.ChunkSize = size
+	header, err := newFileHeader(opts, "testpassword")
+	if err != nil {
+		b.Fatalf("Failed to create header: %v", err)
+	}
+	keys, err := header.layerKeys(secrets{password: "testpassword"})
+	if err != nil {
+		b.Fatalf("Failed to derive keys: %v", err)
+	}
+	return header, keys
+}
+
+// BenchmarkEncryptChunkSize measures the encryption throughput for every chunk size
+func BenchmarkEncryptChunkSize(b *testing.B) {
+	plaintext := make([]byte, benchmarkPayload)
+	for _, size := range benchmarkChunkSizes {
+		header, keys := benchmarkKeys(b, size, 1)
+		b.Run(fmt.Sprintf("chunk=%dKiB", size/1024), func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				writer, err := newLayeredWriter(io.Discard, header, keys, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := writer.Write(plaintext); err != nil {
+					b.Fatal(err)
+				}
+				if err := writer.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecryptChunkSize measures the decryption throughput for every chunk size
+func BenchmarkDecryptChunkSize(b *testing.B) {
+	plaintext := make([]byte, benchmarkPayload)
+	for _, size := range benchmarkChunkSizes {
+		header, keys := benchmarkKeys(b, size, 1)
+		var ciphertext bytes.Buffer
+		writer, err := newLayeredWriter(&ciphertext, header, keys, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		writer.Write(plaintext)
+		if err := writer.Close(); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("chunk=%dKiB", size/1024), func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				reader, err := newLayeredReader(bytes.NewReader(ciphertext.Bytes()), header, keys, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEncryptWorkers measures the encryption throughput when the layers seal chunks in parallel
+func BenchmarkEncryptWorkers(b *testing.B) {
+	plaintext := make([]byte, benchmarkPayload)
+	header, keys := benchmarkKeys(b, chunkSize, 3)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				writer, err := newLayeredWriter(io.Discard, header, keys, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := writer.Write(plaintext); err != nil {
+					b.Fatal(err)
+				}
+				if err := writer.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecryptWorkers measures the decryption throughput when the layers open chunks in parallel
+func BenchmarkDecryptWorkers(b *testing.B) {
+	plaintext := make([]byte, benchmarkPayload)
+	header, keys := benchmarkKeys(b, chunkSize, 3)
+	var ciphertext bytes.Buffer
+	writer, err := newLayeredWriter(&ciphertext, header, keys, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	writer.Write(plaintext)
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				reader, err := newLayeredReader(bytes.NewReader(ciphertext.Bytes()), header, keys, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
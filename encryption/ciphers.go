@@ -0,0 +1,131 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher identifiers stored in the header.
+const (
+	cipherXChaCha20Poly1305 = 1
+	cipherAES256GCM         = 2
+)
+
+// Cipher names accepted in Options.Cipher.
+const (
+	CipherXChaCha20Poly1305 = "xchacha20poly1305"
+	CipherAES256GCM         = "aes256gcm"
+)
+
+// cipherSpec describes a cipher that layers can be encrypted with.
+type cipherSpec struct {
+	id        byte
+	name      string
+	nonceSize int // Full nonce size, the nonce prefix stored in the header is streamSuffixSize shorter
+	newAEAD   func(key []byte) (cipher.AEAD, error)
+}
+
+// ciphers lists every supported cipher, the first one is the default.
+// All of them take a 32 byte key. Every file and layer gets its own key, so the 7 byte random
+// prefix of AES-256-GCM's 12 byte nonce only has to keep the chunks of one layer apart, which
+// the chunk counter already does.
+var ciphers = []cipherSpec{
+	{id: cipherXChaCha20Poly1305, name: CipherXChaCha20Poly1305, nonceSize: chacha20poly1305.NonceSizeX, newAEAD: chacha20poly1305.NewX},
+	{id: cipherAES256GCM, name: CipherAES256GCM, nonceSize: 12, newAEAD: newAES256GCM},
+}
+
+// newAES256GCM creates an AES-256-GCM AEAD.
+func newAES256GCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid AES-256 key length: %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Ciphers returns the names of the supported ciphers, starting with the default.
+func Ciphers() []string {
+	names := make([]string, len(ciphers))
+	for i, spec := range ciphers {
+		names[i] = spec.name
+	}
+	return names
+}
+
+// ParseCipher checks a cipher name and returns its canonical form.
+func ParseCipher(name string) (string, error) {
+	spec, err := cipherByName(name)
+	return spec.name, err
+}
+
+// layerCiphers returns the cipher of every layer, starting with the innermost one. A cascade is
+// repeated when there are more layers than ciphers in it, so "aes256gcm, xchacha20poly1305" over
+// 3 layers puts AES-256-GCM inside XChaCha20-Poly1305 inside AES-256-GCM.
+func layerCiphers(opts Options) ([]cipherSpec, error) {
+	names := opts.Cascade
+	if len(names) == 0 {
+		names = []string{opts.Cipher}
+	} else if len(names) > opts.Layers {
+		return nil, fmt.Errorf("a cascade of %d ciphers needs at least %d layers, got %d", len(names), len(names), opts.Layers)
+	}
+
+	specs := make([]cipherSpec, opts.Layers)
+	for i := range specs {
+		spec, err := cipherByName(names[i%len(names)])
+		if err != nil {
+			return nil, err
+		}
+		specs[i] = spec
+	}
+	return specs, nil
+}
+
+// cipherByName looks up a cipher by name. Case and dashes are ignored, so "AES-256-GCM" works too,
+// and an empty name selects the default.
+func cipherByName(name string) (cipherSpec, error) {
+	if name == "" {
+		return ciphers[0], nil
+	}
+	normalized := strings.ReplaceAll(strings.ToLower(name), "-", "")
+	for _, spec := range ciphers {
+		if spec.name == normalized {
+			return spec, nil
+		}
+	}
+	return cipherSpec{}, fmt.Errorf("unknown cipher %q, use one of: %s", name, strings.Join(Ciphers(), ", "))
+}
+
+// cipherByID looks up a cipher by the identifier stored in the header.
+func cipherByID(id byte) (cipherSpec, bool) {
+	for _, spec := range ciphers {
+		if spec.id == id {
+			return spec, true
+		}
+	}
+	return cipherSpec{}, false
+}
+
+// newAEAD creates the cipher used by a layer.
+func newAEAD(cipherID byte, key []byte) (cipher.AEAD, error) {
+	spec, ok := cipherByID(cipherID)
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher: %d", cipherID)
+	}
+	return spec.newAEAD(key)
+}
+
+// noncePrefixSize returns the length of the nonce prefix stored for a cipher, or 0 if the cipher is unknown.
+func noncePrefixSize(cipherID byte) int {
+	spec, ok := cipherByID(cipherID)
+	if !ok {
+		return 0
+	}
+	return spec.nonceSize - streamSuffixSize
+}
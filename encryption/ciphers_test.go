@@ -0,0 +1,158 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestCipherByName tests cipher name lookup and its aliases
+func TestCipherByName(t *testing.T) {
+	tests := map[string]byte{
+		"":                   cipherXChaCha20Poly1305,
+		"xchacha20poly1305":  cipherXChaCha20Poly1305,
+		"XChaCha20-Poly1305": cipherXChaCha20Poly1305,
+		"aes256gcm":          cipherAES256GCM,
+		"AES-256-GCM":        cipherAES256GCM,
+	}
+	for name, id := range tests {
+		spec, err := cipherByName(name)
+		if err != nil || spec.id != id {
+			t.Errorf("Expected %q to select cipher %d, got %d (%v)", name, id, spec.id, err)
+		}
+	}
+	if _, err := cipherByName("rot13"); err == nil {
+		t.Errorf("Expected an unknown cipher to be refused")
+	}
+}
+
+// TestCipherRoundTrip tests every cipher through the streaming, parallel and random access readers
+func TestCipherRoundTrip(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 3*chunkSize+42)
+	rand.Read(plaintext)
+
+	for _, name := range Ciphers() {
+		opts := testOptions(3)
+		opts.Cipher = name
+		var ciphertext bytes.Buffer
+		if err := encryptTo(&ciphertext, bytes.NewReader(plaintext), key, opts); err != nil {
+			t.Fatalf("%s: encryption failed: %v", name, err)
+		}
+
+		// Every layer records the cipher and a nonce prefix that fits it
+		spec, _ := cipherByName(name)
+		header, err := readHeader(bytes.NewReader(ciphertext.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: failed to read header: %v", name, err)
+		}
+		for i, layer := range header.layers {
+			if layer.cipher != spec.id || len(layer.noncePrefix) != spec.nonceSize-streamSuffixSize {
+				t.Errorf("%s: layer %d has cipher %d with a %d byte nonce prefix", name, i+1, layer.cipher, len(layer.noncePrefix))
+			}
+		}
+
+		for _, workers := range []int{1, 4} {
+			reader, err := NewDecryptReaderWithOptions(bytes.NewReader(ciphertext.Bytes()), key, DecryptOptions{Workers: workers})
+			if err != nil {
+				t.Fatalf("%s: failed to create decrypt reader: %v", name, err)
+			}
+			decrypted, err := io.ReadAll(reader)
+			if err != nil || !bytes.Equal(plaintext, decrypted) {
+				t.Errorf("%s with %d workers: round trip failed: %v", name, workers, err)
+			}
+		}
+
+		readerAt, err := NewDecryptReaderAt(bytes.NewReader(ciphertext.Bytes()), int64(ciphertext.Len()), key)
+		if err != nil {
+			t.Fatalf("%s: failed to open for random access: %v", name, err)
+		}
+		part := make([]byte, 100)
+		if _, err := readerAt.ReadAt(part, chunkSize-50); err != nil || !bytes.Equal(part, plaintext[chunkSize-50:chunkSize+50]) {
+			t.Errorf("%s: random access read failed: %v", name, err)
+		}
+
+		if _, err := decryptTestData(ciphertext.Bytes(), "otherpassword", DecryptOptions{}); !errors.Is(err, ErrWrongPassword) {
+			t.Errorf("%s: expected ErrWrongPassword, got %v", name, err)
+		}
+	}
+}
+
+// TestCipherSwappedInHeader tests that changing the recorded cipher makes decryption fail
+func TestCipherSwappedInHeader(t *testing.T) {
+	key := "testpassword"
+	opts := testOptions(1)
+	opts.Cipher = CipherAES256GCM
+	var ciphertext bytes.Buffer
+	if err := encryptTo(&ciphertext, bytes.NewReader([]byte("some data")), key, opts); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// The cipher id sits right after the layer count, the nonce prefix sizes differ, so the header is misread
+	data := ciphertext.Bytes()
+	header, _ := readHeader(bytes.NewReader(data))
+	data[len(header.associatedData())-len(header.layers[0].noncePrefix)-1] = cipherXChaCha20Poly1305
+	if _, err := decryptTestData(data, key, DecryptOptions{}); err == nil {
+		t.Errorf("Expected decryption with a swapped cipher to fail")
+	}
+}
+
+// TestCascadeLayers tests that a cascade alternates the ciphers over the layers and reads back
+func TestCascadeLayers(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 2*chunkSize+99)
+	rand.Read(plaintext)
+
+	opts := testOptions(3)
+	opts.Cascade = []string{CipherAES256GCM, CipherXChaCha20Poly1305}
+	var ciphertext bytes.Buffer
+	if err := encryptTo(&ciphertext, bytes.NewReader(plaintext), key, opts); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	header, err := readHeader(bytes.NewReader(ciphertext.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	expected := []byte{cipherAES256GCM, cipherXChaCha20Poly1305, cipherAES256GCM}
+	for i, layer := range header.layers {
+		if layer.cipher != expected[i] {
+			t.Errorf("Expected layer %d to use cipher %d, got %d", i+1, expected[i], layer.cipher)
+		}
+	}
+
+	// The layers must not share keys, even where they use the same cipher
+	keys, err := header.layerKeys(secrets{password: key})
+	if err != nil {
+		t.Fatalf("Failed to derive keys: %v", err)
+	}
+	if bytes.Equal(keys[0], keys[2]) {
+		t.Errorf("Expected independent keys for layers with the same cipher")
+	}
+
+	decrypted, err := decryptTestData(ciphertext.Bytes(), key, DecryptOptions{})
+	if err != nil || !bytes.Equal(plaintext, decrypted) {
+		t.Errorf("Cascade round trip failed: %v", err)
+	}
+	readerAt, err := NewDecryptReaderAt(bytes.NewReader(ciphertext.Bytes()), int64(ciphertext.Len()), key)
+	if err != nil || readerAt.Size() != int64(len(plaintext)) {
+		t.Errorf("Failed to open the cascade for random access: %v", err)
+	}
+}
+
+// TestCascadeInvalid tests that cascades that cannot be applied are refused
+func TestCascadeInvalid(t *testing.T) {
+	tests := map[string]Options{
+		"more ciphers than layers": {Layers: 1, Cascade: []string{CipherAES256GCM, CipherXChaCha20Poly1305}},
+		"unknown cipher":           {Layers: 2, Cascade: []string{CipherAES256GCM, "rot13"}},
+	}
+	for name, cascade := range tests {
+		opts := testOptions(cascade.Layers)
+		opts.Cascade = cascade.Cascade
+		if _, err := newFileHeader(opts, "testpassword"); err == nil {
+			t.Errorf("%s: expected the cascade to be refused", name)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package encryption
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"testing/iotest"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // This function tests encrypting and decrypting a file. It also verifies the output hash matches the original file.
@@ -54,6 +60,15 @@ func DecryptTestFile(encryptedFilePath, password string) (string, error) {
 	return decryptedFilePath, nil
 }
 
+// readTestFile returns the contents of the file at filePath
+func readTestFile(t *testing.T, filePath string) []byte {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", filePath, err)
+	}
+	return data
+}
+
 // hashFile computes the SHA-256 hash of a file and returns it as a hex string
 func hashFile(filePath string) (string, error) {
 	file, err := os.Open(filePath)
@@ -262,4 +277,465 @@ func TestDecryptFileError(t *testing.T) {
 	if err == nil {
 		t.Fatalf("Expected decryption to fail with invalid input")
 	}
-}
\ No newline at end of file
+}
+
+// writeLegacyTestFile writes data in the original layered format, where every chunk of a layer reused the same nonce
+func writeLegacyTestFile(filePath, password string, data []byte, layers int) error {
+	for layer := 0; layer < layers; layer++ {
+		salt, err := GenerateSalt()
+		if err != nil {
+			return err
+		}
+		aead, err := chacha20poly1305.NewX(DeriveKey(password, salt))
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, chacha20poly1305.NonceSizeX)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+
+		var layerData bytes.Buffer
+		layerData.WriteByte(byte(layer + 1))
+		layerData.Write(nonce)
+		layerData.Write(salt)
+		for offset := 0; offset < len(data); offset += 32 * 1024 {
+			end := offset + 32*1024
+			if end > len(data) {
+				end = len(data)
+			}
+			layerData.Write(aead.Seal(nil, nonce, data[offset:end], nil))
+		}
+		data = layerData.Bytes()
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+// TestDecryptLegacyFile tests that files written before per-chunk nonces can still be decrypted
+func TestDecryptLegacyFile(t *testing.T) {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	encryptedFilePath := filepath.Join(workingDir, "test_legacy.enc")
+	key := "testpassword"
+	originalData := make([]byte, 100*1024) // Spans several chunks
+	rand.Read(originalData)
+
+	if err := writeLegacyTestFile(encryptedFilePath, key, originalData, 3); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+	defer os.Remove(encryptedFilePath)
+
+	decryptedFilePath, err := DecryptTestFile(encryptedFilePath, key)
+	if err != nil {
+		t.Fatalf("Decryption of legacy file failed: %v", err)
+	}
+	defer os.Remove(decryptedFilePath)
+
+	decryptedData, err := os.ReadFile(decryptedFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	if !bytes.Equal(originalData, decryptedData) {
+		t.Errorf("Decrypted legacy data does not match the original")
+	}
+}
+
+// TestEncryptAndDecryptWithoutTempFiles tests that layered encryption and decryption do not write temp files
+func TestEncryptAndDecryptWithoutTempFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+	t.Setenv("TMP", tempDir)
+	t.Setenv("TEMP", tempDir)
+
+	testFilePath := filepath.Join(t.TempDir(), "test_input.txt")
+	key := "testpassword"
+	originalData := make([]byte, 200*1024)
+	rand.Read(originalData)
+	if err := os.WriteFile(testFilePath, originalData, 0644); err != nil {
+		t.Fatalf("Failed to create test input file: %v", err)
+	}
+
+	encryptedFilePath, err := EncryptTestFile(testFilePath, key, 5)
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	decryptedFilePath, err := DecryptTestFile(encryptedFilePath, key)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+
+	decryptedData, err := os.ReadFile(decryptedFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	if !bytes.Equal(originalData, decryptedData) {
+		t.Errorf("Decrypted data does not match the original")
+	}
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read temp directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no temp files, found %d", len(entries))
+	}
+}
+
+// TestDecryptWrongPasswordRemovesOutput tests that a failed decryption does not leave partial output behind
+func TestDecryptWrongPasswordRemovesOutput(t *testing.T) {
+	testFilePath := filepath.Join(t.TempDir(), "test_input.txt")
+	if err := os.WriteFile(testFilePath, []byte("This is a test file for encryption."), 0644); err != nil {
+		t.Fatalf("Failed to create test input file: %v", err)
+	}
+
+	encryptedFilePath, err := EncryptTestFile(testFilePath, "testpassword", 2)
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if _, err := DecryptTestFile(encryptedFilePath, "wrongpassword"); err == nil {
+		t.Fatalf("Expected decryption to fail with wrong password")
+	}
+
+	decryptedFilePath := encryptedFilePath[:len(encryptedFilePath)-4] + ".dec"
+	if _, err := os.Stat(decryptedFilePath); !os.IsNotExist(err) {
+		t.Errorf("Expected no output file after a failed decryption")
+	}
+}
+
+// testOptions returns options with cheap KDF parameters to keep the tests fast
+func testOptions(layers int) Options {
+	opts := DefaultOptions(layers)
+	opts.KDF = KDFParams{Time: 1, Memory: minKDFMemory, Threads: 1}
+	return opts
+}
+
+// TestEncryptWriterDecryptReader tests the streaming API with in-memory buffers
+func TestEncryptWriterDecryptReader(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 5*chunkSize+7)
+	rand.Read(plaintext)
+
+	var ciphertext bytes.Buffer
+	writer, err := NewEncryptWriter(&ciphertext, key, testOptions(4))
+	if err != nil {
+		t.Fatalf("Failed to create encrypt writer: %v", err)
+	}
+	if _, err := writer.Write(plaintext); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Every layer adds one tag per chunk, so the output must be larger than a single layer would be
+	chunks := len(plaintext)/chunkSize + 1
+	if ciphertext.Len() <= len(plaintext)+chunks*chacha20poly1305.Overhead+len(headerMagic) {
+		t.Fatalf("Expected every layer to be applied, got %d bytes", ciphertext.Len())
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(ciphertext.Bytes()), key)
+	if err != nil {
+		t.Fatalf("Failed to create decrypt reader: %v", err)
+	}
+	decrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(plaintext, decrypted) {
+		t.Errorf("Plaintext mismatch after the streaming round trip")
+	}
+}
+
+// TestEncryptWriterMatchesFileFormat tests that the streaming API and the file functions read each other's output
+func TestEncryptWriterMatchesFileFormat(t *testing.T) {
+	key := "testpassword"
+	originalData := []byte("This is a test file for encryption.")
+
+	// Encrypt to a buffer and decrypt it as a file
+	var ciphertext bytes.Buffer
+	writer, err := NewEncryptWriter(&ciphertext, key, testOptions(3))
+	if err != nil {
+		t.Fatalf("Failed to create encrypt writer: %v", err)
+	}
+	writer.Write(originalData)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	encryptedFilePath := filepath.Join(t.TempDir(), "test_stream.enc")
+	if err := os.WriteFile(encryptedFilePath, ciphertext.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write encrypted file: %v", err)
+	}
+	decryptedFilePath, err := DecryptTestFile(encryptedFilePath, key)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	decryptedData, _ := os.ReadFile(decryptedFilePath)
+	if !bytes.Equal(originalData, decryptedData) {
+		t.Errorf("Decrypted file does not match the original")
+	}
+
+	// Encrypt as a file and decrypt it as a stream
+	testFilePath := filepath.Join(t.TempDir(), "test_input.txt")
+	os.WriteFile(testFilePath, originalData, 0644)
+	encryptedFilePath, err = EncryptTestFile(testFilePath, key, 3)
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	encryptedFile, err := os.Open(encryptedFilePath)
+	if err != nil {
+		t.Fatalf("Failed to open encrypted file: %v", err)
+	}
+	defer encryptedFile.Close()
+
+	reader, err := NewDecryptReader(encryptedFile, key)
+	if err != nil {
+		t.Fatalf("Failed to create decrypt reader: %v", err)
+	}
+	decryptedData, err = io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(originalData, decryptedData) {
+		t.Errorf("Decrypted stream does not match the original")
+	}
+}
+
+// TestEncryptChunkSizes tests round trips with different chunk sizes and that the chunks have the recorded size
+func TestEncryptChunkSizes(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 3*1024*1024+5)
+	rand.Read(plaintext)
+
+	for _, size := range []int{minChunkSize, 4096, chunkSize, 1024 * 1024} {
+		opts := testOptions(2)
+		opts.ChunkSize = size
+		var ciphertext bytes.Buffer
+		if err := encryptTo(&ciphertext, bytes.NewReader(plaintext), key, opts); err != nil {
+			t.Fatalf("Encryption with chunk size %d failed: %v", size, err)
+		}
+
+		// Every layer adds a tag per chunk of its input, including the empty final chunk when the input fills its chunks
+		header, err := readHeader(bytes.NewReader(ciphertext.Bytes()))
+		if err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+		expected := len(plaintext)
+		for layer := 0; layer < 2; layer++ {
+			expected += (expected/size + 1) * chacha20poly1305.Overhead
+		}
+		if header.chunkSize != uint32(size) || ciphertext.Len()-len(header.raw) != expected {
+			t.Errorf("Chunk size %d: expected %d bytes of payload, got %d with chunk size %d", size, expected, ciphertext.Len()-len(header.raw), header.chunkSize)
+		}
+
+		decrypted, err := decryptTestData(ciphertext.Bytes(), key, DecryptOptions{})
+		if err != nil {
+			t.Fatalf("Decryption with chunk size %d failed: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, decrypted) {
+			t.Errorf("Plaintext mismatch with chunk size %d", size)
+		}
+	}
+}
+
+// TestNewDecryptReaderRejectsPlainData tests that data without a GoCrypt header is refused
+func TestNewDecryptReaderRejectsPlainData(t *testing.T) {
+	if _, err := NewDecryptReader(bytes.NewReader([]byte("\x00\x00 not encrypted at all")), "testpassword"); err == nil {
+		t.Fatalf("Expected plain data to be refused")
+	}
+}
+
+// TestDecryptTruncatedAtChunkBoundaries tests that files cut exactly between two chunks are refused as truncated
+func TestDecryptTruncatedAtChunkBoundaries(t *testing.T) {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	key := "testpassword"
+	testFilePath := filepath.Join(workingDir, "test_truncated.txt")
+	originalData := make([]byte, 4*chunkSize) // Ends on a chunk boundary, so the final chunk is full too
+	rand.Read(originalData)
+	if err := os.WriteFile(testFilePath, originalData, 0644); err != nil {
+		t.Fatalf("Failed to create test input file: %v", err)
+	}
+	defer os.Remove(testFilePath)
+
+	for _, layers := range []int{1, 3} {
+		inputFile, err := os.Open(testFilePath)
+		if err != nil {
+			t.Fatalf("Failed to open test input file: %v", err)
+		}
+		encryptedFilePath := testFilePath + ".enc"
+		err = LayeredEncryptFileWithOptions(inputFile, encryptedFilePath, key, testOptions(layers))
+		inputFile.Close()
+		if err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		defer os.Remove(encryptedFilePath)
+
+		data, err := os.ReadFile(encryptedFilePath)
+		if err != nil {
+			t.Fatalf("Failed to read encrypted file: %v", err)
+		}
+		header, err := readHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+
+		// Cut the file after every chunk of the outermost layer except the last one
+		sealedChunk := chunkSize + chacha20poly1305.Overhead
+		for end := len(header.raw) + sealedChunk; end < len(data); end += sealedChunk {
+			if err := os.WriteFile(encryptedFilePath, data[:end], 0644); err != nil {
+				t.Fatalf("Failed to write truncated file: %v", err)
+			}
+			decryptedFilePath, err := DecryptTestFile(encryptedFilePath, key)
+			if !errors.Is(err, ErrTruncated) {
+				t.Errorf("%d layers, cut at %d of %d bytes: expected ErrTruncated, got %v", layers, end, len(data), err)
+			}
+			if err == nil {
+				os.Remove(decryptedFilePath)
+			}
+		}
+	}
+}
+
+// TestDecryptAppendedData tests that data appended after the final chunk is refused
+func TestDecryptAppendedData(t *testing.T) {
+	key := "testpassword"
+	for _, size := range []int{100, 2 * chunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		ciphertext := encryptTestData(t, key, plaintext, testOptions(2))
+
+		for _, extra := range [][]byte{{0}, make([]byte, chacha20poly1305.Overhead), bytes.Repeat([]byte{0xaa}, chunkSize)} {
+			if _, err := decryptTestData(append(bytes.Clone(ciphertext), extra...), key, DecryptOptions{}); err == nil {
+				t.Errorf("Expected %d bytes appended to a %d byte file to be refused", len(extra), size)
+			}
+		}
+	}
+}
+
+// shortReaders wrap a reader so every Read returns less than asked for
+var shortReaders = map[string]func(io.Reader) io.Reader{
+	"one byte": iotest.OneByteReader,
+	"half":     iotest.HalfReader,
+	"data err": iotest.DataErrReader,
+	"pipe":     pipeReader,
+}
+
+// pipeReader feeds the data through an io.Pipe in small odd-sized writes, like a slow network stream
+func pipeReader(source io.Reader) io.Reader {
+	reader, writer := io.Pipe()
+	go func() {
+		buffer := make([]byte, 1021)
+		for {
+			n, err := source.Read(buffer)
+			if n > 0 {
+				if _, err := writer.Write(buffer[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return reader
+}
+
+// TestFramingIndependentOfReadSizes tests that encryption and decryption work the same whatever Read returns
+func TestFramingIndependentOfReadSizes(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 3*chunkSize+77)
+	rand.Read(plaintext)
+	expected := encryptTestData(t, key, plaintext, testOptions(2))
+
+	legacyPath := filepath.Join(t.TempDir(), "legacy.enc")
+	if err := writeLegacyTestFile(legacyPath, key, plaintext, 2); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+	legacy, err := os.ReadFile(legacyPath)
+	if err != nil {
+		t.Fatalf("Failed to read legacy file: %v", err)
+	}
+
+	for name, shortReader := range shortReaders {
+		// The chunks are always full, so the ciphertext has the same size as with whole reads
+		var ciphertext bytes.Buffer
+		if err := encryptTo(&ciphertext, shortReader(bytes.NewReader(plaintext)), key, testOptions(2)); err != nil {
+			t.Fatalf("%s: encryption failed: %v", name, err)
+		}
+		if ciphertext.Len() != len(expected) {
+			t.Errorf("%s: expected %d bytes of ciphertext, got %d", name, len(expected), ciphertext.Len())
+		}
+
+		for format, data := range map[string][]byte{"header": ciphertext.Bytes(), "legacy": legacy} {
+			reader, err := NewDecryptReader(shortReader(bytes.NewReader(data)), key)
+			if err != nil {
+				t.Fatalf("%s: failed to create decrypt reader for %s file: %v", name, format, err)
+			}
+			decrypted, err := io.ReadAll(reader)
+			if err != nil {
+				t.Errorf("%s: decryption of %s file failed: %v", name, format, err)
+			} else if !bytes.Equal(plaintext, decrypted) {
+				t.Errorf("%s: plaintext mismatch for %s file", name, format)
+			}
+		}
+	}
+}
+
+// TestDeprecatedFunctionsWithPipes tests EncryptFile and DecryptFile on pipes, which return short reads
+func TestDeprecatedFunctionsWithPipes(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 2*chunkSize+300)
+	rand.Read(plaintext)
+	encryptedFilePath := filepath.Join(t.TempDir(), "deprecated.enc")
+	decryptedFilePath := filepath.Join(t.TempDir(), "deprecated.dec")
+
+	// pipe returns the read end of a pipe that receives the data in small writes
+	pipe := func(data []byte) *os.File {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("Failed to create pipe: %v", err)
+		}
+		go func() {
+			defer writer.Close()
+			for offset := 0; offset < len(data); offset += 1000 {
+				if _, err := writer.Write(data[offset:min(offset+1000, len(data))]); err != nil {
+					return
+				}
+			}
+		}()
+		return reader
+	}
+
+	source := pipe(plaintext)
+	err := EncryptFile(source, encryptedFilePath, key)
+	source.Close()
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ciphertext, err := os.ReadFile(encryptedFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+
+	source = pipe(ciphertext)
+	err = DecryptFile(source, decryptedFilePath, key)
+	source.Close()
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	decrypted, err := os.ReadFile(decryptedFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	if !bytes.Equal(plaintext, decrypted) {
+		t.Errorf("Plaintext mismatch after the round trip through pipes")
+	}
+}
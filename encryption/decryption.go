@@ -1,6 +1,7 @@
 package encryption
 
 import (
+	"crypto/cipher"
 	"fmt"
 	"io"
 	"os"
@@ -35,11 +36,12 @@ func DecryptFile(source *os.File, pathOut, password string) error {
 	defer os.Remove(tmpFile.Name())
 
 	// Adjust the buffer size to account for the MAC overhead
-	encryptedBuffer := make([]byte, 32*1024+16) // Buffer to hold ciphertext
-	plaintextBuffer := make([]byte, 32*1024)    // Buffer for decrypted plaintext
+	encryptedBuffer := make([]byte, legacyChunkSize+16) // Buffer to hold ciphertext
+	plaintextBuffer := make([]byte, legacyChunkSize)    // Buffer for decrypted plaintext
 
 	for {
-		n, err := source.Read(encryptedBuffer)
+		// Read whole chunks, a short read from the source must not split one
+		n, err := io.ReadFull(source, encryptedBuffer)
 		if n > 0 {
 			// Decrypt the buffer chunk
 			plaintext, err := aead.Open(plaintextBuffer[:0], nonce, encryptedBuffer[:n], nil)
@@ -50,7 +52,7 @@ func DecryptFile(source *os.File, pathOut, password string) error {
 				return fmt.Errorf("failed to write decrypted data: %v", err)
 			}
 		}
-		if err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
 		}
 		if err != nil {
@@ -66,15 +68,100 @@ func DecryptFile(source *os.File, pathOut, password string) error {
 	return nil
 }
 
+// DecryptOptions controls how LayeredDecryptFileWithOptions decrypts a file.
+type DecryptOptions struct {
+	Workers int    // Chunks opened at the same time, shared by the layers, 0 or 1 opens them one by one
+	Keyfile []byte // Key material from ReadKeyfile, needed for files encrypted with a keyfile
+
+	// Identities from ReadIdentities, needed for files encrypted to recipients
+	Identities []*X25519Identity
+}
+
+// secrets returns the password and the key material in opts.
+func (opts DecryptOptions) secrets(password string) secrets {
+	return secrets{password: password, keyfile: opts.Keyfile, identities: opts.Identities}
+}
+
 // LayeredDecryptFile decrypts the file with multiple layers using ChaCha20-Poly1305.
-// This functin automatically detects the layer count in the header.
+// This functin automatically detects the file format and the layer count in the header.
 func LayeredDecryptFile(source *os.File, pathOut, password string) error {
-	var currentSource *os.File = source
+	return LayeredDecryptFileWithOptions(source, pathOut, password, DecryptOptions{})
+}
+
+// LayeredDecryptFileWithOptions decrypts the file with multiple layers using ChaCha20-Poly1305.
+// It is a thin wrapper around NewDecryptReaderWithOptions that writes the result to pathOut.
+func LayeredDecryptFileWithOptions(source *os.File, pathOut, password string, opts DecryptOptions) error {
+	reader, err := NewDecryptReaderWithOptions(source, password, opts)
+	if err != nil {
+		return err
+	}
+
+	outputFile, err := os.Create(pathOut)
+	if err != nil {
+		return err
+	}
+
+	// Remove the partial output if anything goes wrong
+	if _, err := io.Copy(outputFile, reader); err != nil {
+		outputFile.Close()
+		os.Remove(pathOut)
+		return err
+	}
+	return outputFile.Close()
+}
+
+// NewDecryptReader returns a reader that decrypts the data read from source. The format and the layer
+// count are detected automatically, and files written before the header and per-chunk nonces were
+// introduced are still supported. The header is read straight away, the payload is decrypted chunk
+// by chunk as it is read and authenticated before it is returned.
+func NewDecryptReader(source io.Reader, password string) (io.Reader, error) {
+	return NewDecryptReaderWithOptions(source, password, DecryptOptions{})
+}
+
+// NewDecryptReaderWithOptions works like NewDecryptReader. With opts.Workers above 1 the layers of
+// a file with a header read ahead and open several chunks in parallel, older formats are always
+// decrypted one chunk at a time.
+func NewDecryptReaderWithOptions(source io.Reader, password string, opts DecryptOptions) (io.Reader, error) {
+	format, reader, err := detectFormat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatHeader:
+		header, err := readHeader(reader)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := header.layerKeys(opts.secrets(password))
+		if err != nil {
+			return nil, err
+		}
+		return newLayeredReader(reader, header, keys, opts.Workers)
+	case FormatAge:
+		return newAgeReader(reader, opts.secrets(password), opts.Workers)
+	case FormatStream, FormatLegacy:
+		return newNestedReader(reader, password, format == FormatStream)
+	default:
+		return nil, ErrNotGoCrypt
+	}
+}
 
-	// Read the layer header before entering the loop
+// newNestedReader decrypts files without a header, where every layer starts with its own layer byte, nonce and salt.
+// Stream format files use per-chunk nonces, legacy files reuse one nonce per layer.
+// The header of every inner layer is read from the decrypted output of the layer around it.
+func newNestedReader(source io.Reader, password string, streamFormat bool) (io.Reader, error) {
+	var currentSource io.Reader = source
+
+	// Read the layer header before entering the loop, skipping the format marker and version
+	if streamFormat {
+		if _, err := io.ReadFull(currentSource, make([]byte, 2)); err != nil {
+			return nil, readError("format marker", err)
+		}
+	}
 	layerHeader := make([]byte, 1)
 	if _, err := io.ReadFull(currentSource, layerHeader); err != nil {
-		return fmt.Errorf("failed to read initial layer header: %v", err)
+		return nil, readError("initial layer header", err)
 	}
 	totalLayers := int(layerHeader[0])
 	//fmt.Printf("Total layers to decrypt: %d\n", totalLayers)
@@ -85,85 +172,95 @@ func LayeredDecryptFile(source *os.File, pathOut, password string) error {
 		// Skip the first byte (layer header) after the first loop
 		if layer > 0 {
 			if _, err := io.ReadFull(currentSource, layerHeader); err != nil {
-				return fmt.Errorf("failed to skip layer header: %v", err)
+				return nil, readError("layer header", err)
 			}
 		}
 
-		// Read the nonce from the beginning of the file
-		nonce := make([]byte, 24) // 24 bytes nonce
+		// Read the nonce from the beginning of the file, the stream format only stores the nonce prefix
+		nonceSize := chacha20poly1305.NonceSizeX
+		if streamFormat {
+			nonceSize -= streamSuffixSize
+		}
+		nonce := make([]byte, nonceSize)
 		if _, err := io.ReadFull(currentSource, nonce); err != nil {
-			return fmt.Errorf("failed to read nonce: %v", err)
+			return nil, readError("nonce", err)
 		}
 
 		// Read the salt from the file
 		salt := make([]byte, 16) // 16 bytes salt
 		if _, err := io.ReadFull(currentSource, salt); err != nil {
-			return fmt.Errorf("failed to read salt: %v", err)
+			return nil, readError("salt", err)
 		}
 
 		aead, err := chacha20poly1305.NewX(DeriveKey(password, salt))
 		if err != nil {
-			return fmt.Errorf("failed to create AEAD: %v", err)
+			return nil, fmt.Errorf("failed to create AEAD: %v", err)
 		}
 
-		// Create temp file for decrypted output
-		tmpFile, err := os.CreateTemp("", "*.tmp")
-		if err != nil {
-			return err
+		// Continue reading from the decrypted output of this layer
+		if streamFormat {
+			reader, err := newStreamReader(currentSource, aead, nonce, legacyChunkSize, nil)
+			if err != nil {
+				return nil, err
+			}
+			reader.layer = totalLayers - layer
+			reader.outer = layer == 0
+			currentSource = reader
+		} else {
+			currentSource = &legacyReader{source: currentSource, aead: aead, nonce: nonce, layer: totalLayers - layer, outer: layer == 0}
 		}
+	}
 
-		// Buffer setup
-		encryptedBuffer := make([]byte, 32*1024+16) // Buffer to hold ciphertext (32KB + 16 bytes MAC)
-		plaintextBuffer := make([]byte, 32*1024)    // Buffer for decrypted plaintext
+	return currentSource, nil
+}
 
-		for {
-			n, err := currentSource.Read(encryptedBuffer)
-			if n > 0 {
-				// Decrypt the buffer chunk
-				plaintext, err := aead.Open(plaintextBuffer[:0], nonce, encryptedBuffer[:n], nil)
+// legacyReader decrypts a layer written before per-chunk nonces, where every chunk reused the same nonce.
+type legacyReader struct {
+	source    io.Reader
+	aead      cipher.AEAD
+	nonce     []byte
+	layer     int    // Layer number used in error messages
+	outer     bool   // Reads the file itself, so a first chunk that fails to open means a wrong password
+	started   bool   // A chunk has been opened
+	sealed    []byte // Buffer to hold ciphertext (32KB + 16 bytes MAC)
+	buffer    []byte // Buffer for decrypted plaintext
+	plaintext []byte // Decrypted plaintext not returned yet
+	err       error  // First error encountered, returned by every later call
+}
 
-				if err != nil {
-					return fmt.Errorf("layer %d decryption failed: %v", layer+1, err)
-				}
-				if _, err := tmpFile.Write(plaintext); err != nil {
-					return fmt.Errorf("failed to write decrypted data: %v", err)
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return err
-			}
+// Read returns decrypted plaintext, opening the next chunk when needed.
+func (r *legacyReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.err != nil {
+			return 0, r.err
 		}
 
-		// Explicitly close and flush temp file
-		tmpFile.Close()
-
-		// Reopen temp file and reset file pointer to the beginning
-		if currentSource != source {
-			currentSource.Close()
+		if r.sealed == nil {
+			r.sealed = make([]byte, legacyChunkSize+16)
+			r.buffer = make([]byte, legacyChunkSize)
 		}
 
-		currentSource, err = os.Open(tmpFile.Name())
+		// Legacy files were written in full 32KB chunks, only the last one may be shorter
+		n, err := io.ReadFull(r.source, r.sealed)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if n > 0 {
+			// Decrypt the buffer chunk
+			plaintext, openErr := r.aead.Open(r.buffer[:0], r.nonce, r.sealed[:n], nil)
+			if openErr != nil {
+				r.err = fmt.Errorf("layer %d decryption failed: %w", r.layer, authError(r.outer, r.started))
+				return 0, r.err
+			}
+			r.plaintext = plaintext
+			r.started = true
+		}
 		if err != nil {
-			return err
+			r.err = err
 		}
 	}
 
-	currentSource.Close()
-
-	// Copy the contents of the temp file to the output file
-	err := copyFile(currentSource.Name(), pathOut)
-	if err != nil {
-		return fmt.Errorf("failed to copy file: %v", err)
-	}
-
-	// Remove the temp file after a successful copy
-	err = os.Remove(currentSource.Name())
-	if err != nil {
-		return fmt.Errorf("failed to remove temp file: %v", err)
-	}
-
-	return nil
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
 }
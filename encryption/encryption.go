@@ -7,8 +7,6 @@ import (
 	"os"
 
 	"golang.org/x/crypto/chacha20poly1305"
-
-	
 )
 
 // EncryptFile encrypts the file at the given path and writes the encrypted data to the output path using ChaCha20-Poly1305.
@@ -47,11 +45,12 @@ func EncryptFile(source *os.File, pathOut, password string) error {
 	}
 
 	// Adjust the buffer size to account for the MAC overhead
-	buffer := make([]byte, 32*1024)                 // 32KB buffer for reading plaintext
-	encryptedBuffer := make([]byte, 32*1024+16) // Buffer to hold ciphertext (plaintext + 16 bytes MAC)
+	buffer := make([]byte, legacyChunkSize)             // 32KB buffer for reading plaintext
+	encryptedBuffer := make([]byte, legacyChunkSize+16) // Buffer to hold ciphertext (plaintext + 16 bytes MAC)
 
 	for {
-		n, err := source.Read(buffer)
+		// Fill every chunk, so the chunks do not depend on how much a single Read returns
+		n, err := io.ReadFull(source, buffer)
 		if n > 0 {
 			// Encrypt the buffer chunk
 			ciphertext := aead.Seal(encryptedBuffer[:0], nonce, buffer[:n], nil)
@@ -59,7 +58,7 @@ func EncryptFile(source *os.File, pathOut, password string) error {
 				return fmt.Errorf("failed to write encrypted data: %v", err)
 			}
 		}
-		if err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
 		}
 		if err != nil {
@@ -75,99 +74,100 @@ func EncryptFile(source *os.File, pathOut, password string) error {
 	return nil
 }
 
-// LayeredEncryptFile encrypts the file with multiple layers using ChaCha20-Poly1305.
-func LayeredEncryptFile(source *os.File, pathOut, password string, layers int) error {
-    if layers <= 0 {
-		return fmt.Errorf("invalid number of layers: %d", layers)
-	}
-
-	var currentSource *os.File = source
-
-	for layer := 0; layer < layers; layer++ {
-		//fmt.Printf("Starting layer %d encryption...\n", layer+1)
-
-		// Generate a unique salt for each layer
-		salt, err := GenerateSalt()
-		if err != nil {
-			return err
-		}
-
-		aead, err := chacha20poly1305.NewX(DeriveKey(password, salt))
-		if err != nil {
-			return fmt.Errorf("failed to create AEAD: %v", err)
-		}
-
-		// Generate a nonce
-		nonce := make([]byte, 24) // 24 bytes nonce
-		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-			return fmt.Errorf("failed to generate nonce: %v", err)
-		}
+// DefaultChunkSize is the chunk size used by DefaultOptions.
+const DefaultChunkSize = chunkSize
+
+// Options controls how LayeredEncryptFileWithOptions encrypts a file.
+type Options struct {
+	Layers    int       // Number of encryption layers (1-200)
+	KDF       KDFParams // Argon2id parameters of the key slot that holds the file key for the password
+	ChunkSize int       // Plaintext bytes sealed into each chunk (1KiB-16MiB), recorded in the header
+	Workers   int       // Chunks sealed at the same time, shared by the layers, 0 or 1 seals them one by one
+	Cipher    string    // Cipher of every layer, see Ciphers, empty for XChaCha20-Poly1305
+	Cascade   []string  // Ciphers of the layers from the innermost one out, repeated over the layers; replaces Cipher if set
+	Keyfile   []byte    // Key material from ReadKeyfile that is required next to the password, nil for none
+
+	// Recipients the file is encrypted to instead of a password, any of their identities decrypts it
+	Recipients []*X25519Recipient
+
+	// RecoveryCode from GenerateRecoveryCode opens the file through an extra key slot, without the
+	// password or keyfile. Empty for none.
+	RecoveryCode string
+
+	// Format is FormatAge to write an age v1 file, which only uses Recipients and Workers, or
+	// anything else for our own format
+	Format Format
+}
 
-		// Create temp file for current layer
-		tmpFile, err := os.CreateTemp("", "*.tmp")
-		if err != nil {
-			return err
-		}
-		defer os.Remove(tmpFile.Name())
+// DefaultOptions returns the options used by LayeredEncryptFile.
+func DefaultOptions(layers int) Options {
+	return Options{Layers: layers, KDF: DefaultKDFParams(), ChunkSize: DefaultChunkSize}
+}
 
-		// Write the headers to the temp file (layer, nonce, and salt)
-		layerHeader := []byte{byte(layer + 1)} // Convert the current layer to a 1-byte value
-		if _, err := tmpFile.Write(layerHeader); err != nil {
-			return fmt.Errorf("failed to write layer header: %v", err)
-		}
-		if _, err := tmpFile.Write(nonce); err != nil {
-			return fmt.Errorf("failed to write nonce: %v", err)
-		}
-		if _, err := tmpFile.Write(salt); err != nil {
-			return fmt.Errorf("failed to write salt: %v", err)
-		}
+// LayeredEncryptFile encrypts the file with multiple layers using XChaCha20-Poly1305 and the default options.
+func LayeredEncryptFile(source *os.File, pathOut, password string, layers int) error {
+	return LayeredEncryptFileWithOptions(source, pathOut, password, DefaultOptions(layers))
+}
 
-		// Adjust the buffer size to account for the MAC overhead
-		buffer := make([]byte, 32*1024)             // 32KB buffer for reading plaintext
-		encryptedBuffer := make([]byte, 32*1024+16) // Buffer to hold ciphertext (plaintext + 16 bytes MAC)
-
-		for {
-			n, err := currentSource.Read(buffer)
-			if n > 0 {
-				// Encrypt the buffer chunk
-				ciphertext := aead.Seal(encryptedBuffer[:0], nonce, buffer[:n], nil)
-				if _, err := tmpFile.Write(ciphertext); err != nil {
-					return fmt.Errorf("failed to write encrypted data: %v", err)
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return err
-			}
-		}
+// LayeredEncryptFileWithOptions encrypts the file with multiple layers using the cipher in opts.
+// It is a thin wrapper around NewEncryptWriter that writes the result to pathOut.
+func LayeredEncryptFileWithOptions(source *os.File, pathOut, password string, opts Options) error {
+	outputFile, err := os.Create(pathOut)
+	if err != nil {
+		return err
+	}
 
-		tmpFile.Close()
+	// Remove the partial output if anything goes wrong
+	if err := encryptTo(outputFile, source, password, opts); err != nil {
+		outputFile.Close()
+		os.Remove(pathOut)
+		return err
+	}
+	return outputFile.Close()
+}
 
-		// Close the previous source file and set the current source to the new temp file
-		if currentSource != source {
-			currentSource.Close()
-		}
-		currentSource, err = os.Open(tmpFile.Name())
-		if err != nil {
-			return err
-		}
+// encryptTo encrypts everything read from source into dest.
+func encryptTo(dest io.Writer, source io.Reader, password string, opts Options) error {
+	writer, err := NewEncryptWriter(dest, password, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, source); err != nil {
+		return err
 	}
+	return writer.Close()
+}
 
-	currentSource.Close()
+// NewEncryptWriter returns a writer that encrypts everything written to it into dest, in the same
+// format LayeredEncryptFile writes. The header is written to dest straight away.
+// Every chunk of a layer is sealed with its own nonce (see streamWriter) and authenticates the header.
+// The layers are stacked as a pipeline, so the data is encrypted chunk by chunk in memory. With
+// opts.Workers above 1 the layers share that many chunks sealed in parallel, and the output stays the same.
+// With opts.Format set to FormatAge it writes an age v1 file instead.
+// Close must be called to write the final chunks, it does not close dest.
+func NewEncryptWriter(dest io.Writer, password string, opts Options) (io.WriteCloser, error) {
+	if opts.Format == FormatAge {
+		return newAgeWriter(dest, password, opts)
+	}
 
-	// Copy the contents of the temp file to the output file
-	err := copyFile(currentSource.Name(), pathOut)
+	// Build the header first, every layer authenticates it as associated data
+	header, err := newFileHeader(opts, password)
 	if err != nil {
-		return fmt.Errorf("failed to copy file: %v", err)
+		return nil, err
 	}
 
-	// Remove the temp file after a successful copy
-	err = os.Remove(currentSource.Name())
+	// Take the new file key and expand a key for every layer
+	keys, err := header.layerKeys(secrets{password: password, keyfile: opts.Keyfile})
 	if err != nil {
-		return fmt.Errorf("failed to remove temp file: %v", err)
+		return nil, err
 	}
 
-    return nil
-}
\ No newline at end of file
+	writer, err := newLayeredWriter(dest, header, keys, opts.Workers)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dest.Write(header.raw); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+	return writer, nil
+}
@@ -1,12 +1,33 @@
 package encryption
 
 import (
-    "io"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"os"
-    "fmt"
-    "crypto/rand"
-    "crypto/sha256"
-    "golang.org/x/crypto/pbkdf2"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KDFParams tunes the Argon2id key derivation. They are stored in the file header, so files
+// encrypted with different parameters stay decryptable.
+type KDFParams struct {
+	Time    uint32 // Number of passes over the memory
+	Memory  uint32 // Memory in KiB
+	Threads uint8  // Degree of parallelism
+}
+
+const (
+	// minKDFMemory is the lowest Argon2id memory setting accepted for new files (8 MiB).
+	minKDFMemory = 8 * 1024
+
+	// maxKDFMemory and maxKDFTime cap what a header may ask for, so a damaged file cannot hang decryption.
+	maxKDFMemory = 4 * 1024 * 1024
+	maxKDFTime   = 1000
 )
 
 func GenerateSalt() ([]byte, error) {
@@ -19,7 +40,128 @@ func GenerateSalt() ([]byte, error) {
 }
 
 func DeriveKey(password string, salt []byte) []byte {
-    return pbkdf2.Key([]byte(password), salt, 4096, 32, sha256.New)
+	return deriveKeyPBKDF2(password, salt, 4096)
+}
+
+// deriveKeyPBKDF2 derives a 32 byte key with PBKDF2-SHA256 using the given iteration count.
+func deriveKeyPBKDF2(password string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, 32, sha256.New)
+}
+
+// DefaultKDFParams returns the Argon2id parameters used when none are given.
+// They follow the second recommended option of RFC 9106: 3 passes over 64 MiB with 4 threads.
+func DefaultKDFParams() KDFParams {
+	return KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+}
+
+// Validate checks that the parameters are usable for encryption.
+func (p KDFParams) Validate() error {
+	if p.Time == 0 || p.Time > maxKDFTime {
+		return fmt.Errorf("invalid KDF time: %d (must be between 1 and %d)", p.Time, maxKDFTime)
+	}
+	if p.Memory < minKDFMemory || p.Memory > maxKDFMemory {
+		return fmt.Errorf("invalid KDF memory: %d KiB (must be between %d and %d KiB)", p.Memory, minKDFMemory, maxKDFMemory)
+	}
+	if p.Threads == 0 {
+		return fmt.Errorf("invalid KDF threads: 0")
+	}
+	return nil
+}
+
+// deriveKeyArgon2id derives a 32 byte key with Argon2id using the given parameters.
+func deriveKeyArgon2id(password string, salt []byte, params KDFParams) []byte {
+	return argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, 32)
+}
+
+// expandLayerKey derives the 32 byte key of a layer from the master key with HKDF-SHA256.
+// The layer index is part of the info string, so every layer gets an independent key.
+func expandLayerKey(masterKey []byte, layer int) ([]byte, error) {
+	key := make([]byte, 32)
+	info := fmt.Sprintf("GoCrypt layer key %d", layer+1)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, masterKey, []byte(info)), key); err != nil {
+		return nil, fmt.Errorf("failed to expand layer key: %v", err)
+	}
+	return key, nil
+}
+
+// KeyfileSize is the number of random bytes GenerateKeyfile writes.
+const KeyfileSize = 64
+
+// GenerateKeyfile writes a new random keyfile to dest.
+func GenerateKeyfile(dest io.Writer) error {
+	key := make([]byte, KeyfileSize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate keyfile: %v", err)
+	}
+	if _, err := dest.Write(key); err != nil {
+		return fmt.Errorf("failed to write keyfile: %v", err)
+	}
+	return nil
+}
+
+// ReadKeyfile reads a keyfile and returns its key material, the SHA-256 hash of its contents.
+// Any file can be used as a keyfile, but it must not be empty.
+func ReadKeyfile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("keyfile %s is empty", path)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// mixKeyfile combines the key derived from the password with the keyfile material using
+// HKDF-Extract, so the result depends on both and neither is enough on its own.
+func mixKeyfile(key, keyfile []byte) []byte {
+	return hkdf.Extract(sha256.New, key, keyfile)
+}
+
+// CalibrateKDF picks Argon2id parameters that take about target to derive a key on this machine.
+// It keeps the given memory and threads and raises the number of passes, halving the memory only
+// when a single pass is already slower than the target.
+func CalibrateKDF(target time.Duration, memory uint32, threads uint8) (KDFParams, error) {
+	params := KDFParams{Time: 1, Memory: memory, Threads: threads}
+	if err := params.Validate(); err != nil {
+		return params, err
+	}
+	if target <= 0 {
+		return params, fmt.Errorf("invalid calibration target: %s", target)
+	}
+
+	salt, err := GenerateSalt()
+	if err != nil {
+		return params, err
+	}
+
+	for {
+		start := time.Now()
+		deriveKeyArgon2id("calibration", salt, params)
+		elapsed := time.Since(start)
+
+		if elapsed > target && params.Memory/2 >= minKDFMemory {
+			params.Memory /= 2
+			continue
+		}
+
+		// Passes scale the run time linearly, so scale the single pass measurement up to the target
+		passes := int64(target / elapsed)
+		if passes < 1 {
+			passes = 1
+		} else if passes > maxKDFTime {
+			passes = maxKDFTime
+		}
+		params.Time = uint32(passes)
+		return params, nil
+	}
 }
 
 func incrementNonce(nonce []byte) {
@@ -30,21 +172,3 @@ func incrementNonce(nonce []byte) {
         }
     }
 }
-
-// Helper function to copy file contents
-func copyFile(src, dst string) error {
-    sourceFile, err := os.Open(src)
-    if err != nil {
-        return err
-    }
-    defer sourceFile.Close()
-
-    destinationFile, err := os.Create(dst)
-    if err != nil {
-        return err
-    }
-    defer destinationFile.Close()
-
-    _, err = io.Copy(destinationFile, sourceFile)
-    return err
-}
@@ -1,7 +1,13 @@
 package encryption
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // TestDeriveKey tests the key derivation from a password
@@ -40,4 +46,172 @@ func TestGenerateSalt(t *testing.T) {
 	} else if err != nil {
 		t.Fatalf("There was an error while generating salt: %v", err)
 	}
-}
\ No newline at end of file
+}
+// TestDeriveKeyArgon2id tests that Argon2id keys depend on the parameters
+func TestDeriveKeyArgon2id(t *testing.T) {
+	salt, err := GenerateSalt()
+	if err != nil {
+		t.Fatalf("There was an error while generating salt: %v", err)
+	}
+
+	params := KDFParams{Time: 1, Memory: minKDFMemory, Threads: 1}
+	key := deriveKeyArgon2id("testpassword", salt, params)
+	if len(key) != 32 {
+		t.Fatalf("Expected key length to be 32, but got %d", len(key))
+	}
+
+	params.Time = 2
+	if bytes.Equal(key, deriveKeyArgon2id("testpassword", salt, params)) {
+		t.Fatalf("Expected different parameters to derive a different key")
+	}
+}
+
+// TestKDFParamsValidate tests that unusable Argon2id parameters are refused
+func TestKDFParamsValidate(t *testing.T) {
+	if err := DefaultKDFParams().Validate(); err != nil {
+		t.Fatalf("Default parameters should be valid: %v", err)
+	}
+
+	invalid := []KDFParams{
+		{Time: 0, Memory: 64 * 1024, Threads: 1},
+		{Time: 1, Memory: 1024, Threads: 1},
+		{Time: 1, Memory: 64 * 1024, Threads: 0},
+		{Time: maxKDFTime + 1, Memory: 64 * 1024, Threads: 1},
+	}
+	for _, params := range invalid {
+		if err := params.Validate(); err == nil {
+			t.Errorf("Expected parameters %+v to be refused", params)
+		}
+	}
+}
+
+// TestCalibrateKDF tests that calibration returns usable parameters
+func TestCalibrateKDF(t *testing.T) {
+	params, err := CalibrateKDF(50*time.Millisecond, minKDFMemory, 1)
+	if err != nil {
+		t.Fatalf("Calibration failed: %v", err)
+	}
+	if err := params.Validate(); err != nil {
+		t.Fatalf("Calibration returned invalid parameters: %v", err)
+	}
+
+	if _, err := CalibrateKDF(0, minKDFMemory, 1); err == nil {
+		t.Fatalf("Expected calibration to fail without a target")
+	}
+}
+
+// TestExpandLayerKey tests that every layer gets a distinct, repeatable key
+func TestExpandLayerKey(t *testing.T) {
+	masterKey := DeriveKey("testpassword", []byte("0123456789abcdef"))
+
+	first, err := expandLayerKey(masterKey, 0)
+	if err != nil {
+		t.Fatalf("Failed to expand layer key: %v", err)
+	}
+	second, err := expandLayerKey(masterKey, 1)
+	if err != nil {
+		t.Fatalf("Failed to expand layer key: %v", err)
+	}
+	again, _ := expandLayerKey(masterKey, 0)
+
+	if len(first) != 32 {
+		t.Fatalf("Expected key length to be 32, but got %d", len(first))
+	}
+	if bytes.Equal(first, second) {
+		t.Errorf("Expected different layers to get different keys")
+	}
+	if !bytes.Equal(first, again) {
+		t.Errorf("Expected the same layer to get the same key")
+	}
+}
+
+// TestKeyfile tests generating, reading and mixing in a keyfile
+func TestKeyfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.key")
+	var generated bytes.Buffer
+	if err := GenerateKeyfile(&generated); err != nil {
+		t.Fatalf("Failed to generate keyfile: %v", err)
+	}
+	if generated.Len() != KeyfileSize {
+		t.Fatalf("Expected %d bytes of keyfile, got %d", KeyfileSize, generated.Len())
+	}
+	os.WriteFile(path, generated.Bytes(), 0600)
+
+	material, err := ReadKeyfile(path)
+	if err != nil {
+		t.Fatalf("Failed to read keyfile: %v", err)
+	}
+	if len(material) != 32 {
+		t.Errorf("Expected 32 bytes of key material, got %d", len(material))
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.key")
+	os.WriteFile(empty, nil, 0600)
+	if _, err := ReadKeyfile(empty); err == nil {
+		t.Errorf("Expected an empty keyfile to be refused")
+	}
+
+	key := DeriveKey("testpassword", []byte("0123456789abcdef"))
+	if bytes.Equal(mixKeyfile(key, material), key) || bytes.Equal(mixKeyfile(key, material), mixKeyfile(key, make([]byte, 32))) {
+		t.Errorf("Expected the mixed key to depend on the keyfile")
+	}
+}
+
+// TestEncryptWithKeyfile tests that files encrypted with a keyfile need both the password and the keyfile
+func TestEncryptWithKeyfile(t *testing.T) {
+	password := "testpassword"
+	keyfile := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := []byte("secret data behind two factors")
+
+	encrypt := func(password string, keyfile []byte) []byte {
+		opts := testOptions(2)
+		opts.Keyfile = keyfile
+		var ciphertext bytes.Buffer
+		if err := encryptTo(&ciphertext, bytes.NewReader(plaintext), password, opts); err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		return ciphertext.Bytes()
+	}
+	decrypt := func(ciphertext []byte, password string, keyfile []byte) error {
+		reader, err := NewDecryptReaderWithOptions(bytes.NewReader(ciphertext), password, DecryptOptions{Keyfile: keyfile})
+		if err != nil {
+			return err
+		}
+		decrypted, err := io.ReadAll(reader)
+		if err == nil && !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Plaintext mismatch")
+		}
+		return err
+	}
+
+	ciphertext := encrypt(password, keyfile)
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil || len(header.stanzas) != 1 || header.stanzas[0].body[0]&slotKeyfile == 0 {
+		t.Fatalf("Expected the keyfile flag in the key slot, got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		keyfile  []byte
+		want     error
+	}{
+		{"password and keyfile", password, keyfile, nil},
+		{"missing keyfile", password, nil, ErrKeyfileRequired},
+		{"wrong keyfile", password, make([]byte, 32), ErrWrongPassword},
+		{"wrong password", "otherpassword", keyfile, ErrWrongPassword},
+	}
+	for _, test := range tests {
+		if err := decrypt(ciphertext, test.password, test.keyfile); !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+
+	// A keyfile on its own works too, and is ignored for files encrypted without one
+	if err := decrypt(encrypt("", keyfile), "", keyfile); err != nil {
+		t.Errorf("Keyfile only round trip failed: %v", err)
+	}
+	if err := decrypt(encrypt(password, nil), password, keyfile); err != nil {
+		t.Errorf("Expected the keyfile to be ignored for a file without one: %v", err)
+	}
+}
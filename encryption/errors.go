@@ -0,0 +1,44 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors returned when decryption fails, check for them with errors.Is.
+var (
+	// ErrWrongPassword is returned when the first chunk read from the file does not authenticate.
+	// A damaged header or first chunk looks the same, the password (or keyfile) is by far the most likely cause.
+	ErrWrongPassword = errors.New("wrong password")
+
+	// ErrCorrupted is returned when the data was modified after it was encrypted.
+	ErrCorrupted = errors.New("encrypted data is corrupted")
+
+	// ErrTruncated is returned when the data ends before the last chunk.
+	ErrTruncated = errors.New("encrypted data is truncated")
+
+	// ErrUnsupportedVersion is returned for files written by a newer version, with a header
+	// version, cipher or KDF this version does not know.
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+
+	// ErrNotGoCrypt is returned for data that is not in any GoCrypt format.
+	ErrNotGoCrypt = errors.New("not a GoCrypt file")
+
+	// ErrKeyfileRequired is returned when a file encrypted with a keyfile is opened without one.
+	ErrKeyfileRequired = errors.New("a keyfile is required")
+
+	// ErrIdentityRequired is returned when a file encrypted to recipients is opened without an identity.
+	ErrIdentityRequired = errors.New("an identity is required")
+
+	// ErrNoMatchingIdentity is returned when none of the identities is a recipient of the file.
+	ErrNoMatchingIdentity = errors.New("no identity matches a recipient of the file")
+)
+
+// readError describes a failed read, reporting data that ended early as ErrTruncated.
+func readError(what string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return fmt.Errorf("failed to read %s: %w", what, err)
+}
@@ -0,0 +1,112 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptTestData encrypts the plaintext in memory, use testOptions for the cheap test KDF. It writes
+// 1000 bytes at a time, so the writers have to buffer partial chunks.
+func encryptTestData(t *testing.T, password string, plaintext []byte, opts Options) []byte {
+	var ciphertext bytes.Buffer
+	writer, err := NewEncryptWriter(&ciphertext, password, opts)
+	if err != nil {
+		t.Fatalf("Failed to create encrypt writer: %v", err)
+	}
+	for offset := 0; offset < len(plaintext); offset += 1000 {
+		if _, err := writer.Write(plaintext[offset:min(offset+1000, len(plaintext))]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return ciphertext.Bytes()
+}
+
+// decryptTestData decrypts the ciphertext in memory
+func decryptTestData(ciphertext []byte, password string, opts DecryptOptions) ([]byte, error) {
+	reader, err := NewDecryptReaderWithOptions(bytes.NewReader(ciphertext), password, opts)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// TestDecryptErrors tests that every kind of failure is reported with its own error
+func TestDecryptErrors(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+	ciphertext := encryptTestData(t, key, plaintext, testOptions(2))
+
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	headerSize := len(header.raw)
+
+	unsupported := bytes.Clone(ciphertext)
+	unsupported[len(headerMagic)] = maxHeaderVersion + 1
+	corrupted := bytes.Clone(ciphertext)
+	corrupted[len(corrupted)-20] ^= 0x01 // Inside the last chunk, after the first one opened
+
+	legacyPath := filepath.Join(t.TempDir(), "legacy.enc")
+	if err := writeLegacyTestFile(legacyPath, key, plaintext, 2); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+	legacy, err := os.ReadFile(legacyPath)
+	if err != nil {
+		t.Fatalf("Failed to read legacy file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		password string
+		want     error
+	}{
+		{"wrong password", ciphertext, "otherpassword", ErrWrongPassword},
+		{"wrong password legacy", legacy, "otherpassword", ErrWrongPassword},
+		{"corrupted chunk", corrupted, key, ErrCorrupted},
+		{"truncated header", ciphertext[:headerSize-3], key, ErrTruncated},
+		{"truncated payload", ciphertext[:headerSize], key, ErrTruncated},
+		{"unsupported version", unsupported, key, ErrUnsupportedVersion},
+		{"plain data", []byte("\x00\x00 not encrypted at all"), key, ErrNotGoCrypt},
+	}
+	for _, test := range tests {
+		_, err := decryptTestData(test.data, test.password, DecryptOptions{})
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+}
+
+// TestDecryptFirstChunkCorrupted tests that a damaged first chunk is not mistaken for a wrong password
+// once the key slot has proved the password right
+func TestDecryptFirstChunkCorrupted(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+	for _, layers := range []int{1, 2} {
+		ciphertext := encryptTestData(t, key, plaintext, testOptions(layers))
+		header, err := readHeader(bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+		corrupted := bytes.Clone(ciphertext)
+		corrupted[len(header.raw)+1] ^= 0x01
+
+		if _, err := decryptTestData(corrupted, key, DecryptOptions{}); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%d layers: expected ErrCorrupted from the reader, got %v", layers, err)
+		}
+		if _, err := NewDecryptReaderAt(bytes.NewReader(corrupted), int64(len(corrupted)), key); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%d layers: expected ErrCorrupted from the random access reader, got %v", layers, err)
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Format identifies the layout of an encrypted file.
+type Format int
+
+const (
+	FormatUnknown Format = iota // Not a GoCrypt file
+	FormatLegacy                // Original layered format without a header, recognised by a best-effort guess
+	FormatStream                // Per-chunk nonces behind the format marker
+	FormatHeader                // Versioned header starting with the magic bytes
+	FormatAge                   // age v1 file, starting with its version line
+)
+
+const (
+	// headerVersion is the version of the header that derives the master key from the password.
+	// Version 3 derives one master key per file and expands the layer keys from it with HKDF.
+	headerVersion = 3
+
+	// keyWrapVersion is the version of the header written by LayeredEncryptFile. It has no KDF, a random
+	// file key takes the place of the master key and is wrapped in a stanza for every recipient or
+	// key slot.
+	keyWrapVersion = 4
+
+	// maxHeaderVersion is the newest header version that can be read.
+	maxHeaderVersion = keyWrapVersion
+
+	// minHeaderVersion is the oldest header version that can still be read.
+	// Version 2 stores a salt for every layer and runs the KDF once per layer.
+	minHeaderVersion = 2
+
+	// maxLayers is the highest layer count a header may declare.
+	maxLayers = 200
+
+	// minChunkSize is the smallest chunk size accepted for new files, smaller chunks are mostly tag overhead.
+	minChunkSize = 1024
+
+	// maxChunkSize caps the chunk size a header may declare so a damaged file cannot force huge allocations.
+	maxChunkSize = 16 * 1024 * 1024
+
+	// fileKeySize is the length of the random file key of headers with stanzas.
+	fileKeySize = 32
+
+	// maxStanzas is the highest number of stanzas a header may hold.
+	maxStanzas = 255
+)
+
+// Header flags.
+const (
+	// flagKeyfile marks files whose master key mixes in a keyfile next to the password.
+	flagKeyfile = 0x01
+
+	// knownFlags holds every flag this version understands, files with other flags are refused.
+	knownFlags = flagKeyfile
+)
+
+// headerMagic is the start of every file with a versioned header.
+var headerMagic = []byte("GOCRYPT")
+
+// KDF identifiers stored in the header.
+const (
+	kdfPBKDF2SHA256 = 1
+	kdfArgon2id     = 2
+)
+
+// Stanza types stored in the header.
+const (
+	stanzaX25519   = 1 // Ephemeral X25519 public key and the file key sealed for the recipient
+	stanzaPassword = 2 // Argon2id parameters, salt and the file key sealed with the key derived from the password
+)
+
+// stanzaSizes holds the body length of every stanza type.
+var stanzaSizes = map[byte]int{
+	stanzaX25519:   32 + fileKeySize + chacha20poly1305.Overhead,
+	stanzaPassword: passwordStanzaPrefix + fileKeySize + chacha20poly1305.Overhead,
+}
+
+// fileHeader describes everything needed to decrypt the payload that follows it.
+//
+// The encoded header is laid out as:
+//
+//	magic "GOCRYPT" | version | flags | kdf id | kdf params | salt | chunk size (uint32) | layer count
+//
+// followed, for every layer, by its cipher id and nonce prefix. All integers are big endian.
+// The KDF parameters are the iteration count (uint32) for PBKDF2, or time (uint32), memory in KiB (uint32)
+// and threads (uint8) for Argon2id. Version 2 headers have no salt after the KDF parameters and store
+// a salt for every layer between its cipher id and nonce prefix instead.
+//
+// Version 4 headers have no KDF id, parameters or salt, and end with the stanzas instead:
+//
+//	magic "GOCRYPT" | version | flags | chunk size (uint32) | layer count | layers | stanza count | stanzas
+//
+// where every stanza is its type, the length of its body (uint16) and the body. Password stanzas
+// carry their own KDF parameters and salt, so every key slot has its own.
+// The encoded header is passed as associated data to every chunk, so it cannot be altered without
+// decryption failing. The stanzas are left out, every stanza authenticates the header on its own.
+type fileHeader struct {
+	version   byte
+	flags     byte
+	kdf       kdfParams
+	salt      []byte // Salt for the master key (version 3)
+	chunkSize uint32
+	layers    []layerParams
+	stanzas   []keyStanza // Wrapped file keys (version 4)
+	fileKey   []byte      // File key of a header that was just created, never written
+	raw       []byte      // The header as read or written
+}
+
+// keyStanza holds the file key wrapped for one recipient or key slot.
+type keyStanza struct {
+	kind byte
+	body []byte
+}
+
+// kdfParams records the key derivation function used for the file and how it was tuned.
+type kdfParams struct {
+	id         byte
+	iterations uint32    // PBKDF2
+	argon2     KDFParams // Argon2id
+}
+
+// layerParams holds the per-layer values of the header.
+type layerParams struct {
+	cipher      byte
+	salt        []byte // Salt for the layer key (version 2)
+	noncePrefix []byte
+}
+
+// newFileHeader creates a header for a new file with a fresh file key and nonce prefixes for every layer.
+// The file key is wrapped for every recipient, or in a single key slot for the password and keyfile.
+func newFileHeader(opts Options, password string) (*fileHeader, error) {
+	if opts.Layers <= 0 || opts.Layers > maxLayers {
+		return nil, fmt.Errorf("invalid number of layers: %d", opts.Layers)
+	}
+	if err := opts.KDF.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize < minChunkSize || opts.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %d bytes (must be between %d and %d bytes)", opts.ChunkSize, minChunkSize, maxChunkSize)
+	}
+
+	specs, err := layerCiphers(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Recipients) > 0 && opts.Keyfile != nil {
+		return nil, fmt.Errorf("a keyfile cannot be used with recipients")
+	}
+	maxRecipients := maxStanzas
+	if opts.RecoveryCode != "" {
+		maxRecipients-- // The recovery slot takes one stanza
+	}
+	if len(opts.Recipients) > maxRecipients {
+		return nil, fmt.Errorf("too many recipients: %d (at most %d)", len(opts.Recipients), maxRecipients)
+	}
+
+	header := &fileHeader{version: keyWrapVersion, chunkSize: uint32(opts.ChunkSize)}
+	for _, spec := range specs {
+		noncePrefix := make([]byte, noncePrefixSize(spec.id))
+		if _, err := io.ReadFull(rand.Reader, noncePrefix); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %v", err)
+		}
+
+		header.layers = append(header.layers, layerParams{cipher: spec.id, noncePrefix: noncePrefix})
+	}
+	header.raw = header.marshal()
+
+	// The stanzas authenticate the rest of the header, so they are added once it is complete
+	header.fileKey = make([]byte, fileKeySize)
+	if _, err := rand.Read(header.fileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %v", err)
+	}
+	ad := header.associatedData()
+	for _, recipient := range opts.Recipients {
+		stanza, err := recipient.wrap(header.fileKey, ad)
+		if err != nil {
+			return nil, err
+		}
+		header.stanzas = append(header.stanzas, stanza)
+	}
+	if len(opts.Recipients) == 0 {
+		stanza, err := wrapPassword(header.fileKey, ad, PasswordSlot{Password: password, Keyfile: opts.Keyfile, KDF: opts.KDF}, 0)
+		if err != nil {
+			return nil, err
+		}
+		header.stanzas = append(header.stanzas, stanza)
+	}
+	if opts.RecoveryCode != "" {
+		stanza, err := wrapRecovery(header.fileKey, ad, opts.RecoveryCode)
+		if err != nil {
+			return nil, err
+		}
+		header.stanzas = append(header.stanzas, stanza)
+	}
+	header.raw = header.marshal()
+	return header, nil
+}
+
+// marshal encodes the header.
+func (h *fileHeader) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(headerMagic)
+	buf.WriteByte(h.version)
+	buf.WriteByte(h.flags)
+	if h.version < keyWrapVersion {
+		buf.WriteByte(h.kdf.id)
+		switch h.kdf.id {
+		case kdfPBKDF2SHA256:
+			binary.Write(&buf, binary.BigEndian, h.kdf.iterations)
+		case kdfArgon2id:
+			binary.Write(&buf, binary.BigEndian, h.kdf.argon2.Time)
+			binary.Write(&buf, binary.BigEndian, h.kdf.argon2.Memory)
+			buf.WriteByte(h.kdf.argon2.Threads)
+		}
+		buf.Write(h.salt) // Not set in version 2 headers
+	}
+	binary.Write(&buf, binary.BigEndian, h.chunkSize)
+	buf.WriteByte(byte(len(h.layers)))
+	for _, layer := range h.layers {
+		buf.WriteByte(layer.cipher)
+		buf.Write(layer.salt) // Only set in version 2 headers
+		buf.Write(layer.noncePrefix)
+	}
+	if h.version >= keyWrapVersion {
+		buf.WriteByte(byte(len(h.stanzas)))
+		for _, stanza := range h.stanzas {
+			buf.WriteByte(stanza.kind)
+			binary.Write(&buf, binary.BigEndian, uint16(len(stanza.body)))
+			buf.Write(stanza.body)
+		}
+	}
+	return buf.Bytes()
+}
+
+// associatedData returns the part of the encoded header that every chunk authenticates,
+// which is all of it except the stanzas.
+func (h *fileHeader) associatedData() []byte {
+	if h.version < keyWrapVersion {
+		return h.raw
+	}
+	size := 1 // Stanza count
+	for _, stanza := range h.stanzas {
+		size += 3 + len(stanza.body)
+	}
+	return h.raw[:len(h.raw)-size]
+}
+
+// readHeader reads and validates a header, including the magic bytes.
+func readHeader(source io.Reader) (*fileHeader, error) {
+	var raw bytes.Buffer
+	reader := io.TeeReader(source, &raw)
+
+	fixed := make([]byte, len(headerMagic)+2) // magic, version and flags
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, readError("header", err)
+	}
+	if !bytes.HasPrefix(fixed, headerMagic) {
+		return nil, ErrNotGoCrypt
+	}
+
+	header := &fileHeader{version: fixed[len(headerMagic)], flags: fixed[len(headerMagic)+1]}
+	if header.version < minHeaderVersion || header.version > maxHeaderVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header.version)
+	}
+	if header.flags&^knownFlags != 0 || (header.version != headerVersion && header.flags != 0) {
+		return nil, fmt.Errorf("%w: unknown header flags %#x", ErrUnsupportedVersion, header.flags)
+	}
+	if header.version < keyWrapVersion {
+		if err := header.readKDF(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := binary.Read(reader, binary.BigEndian, &header.chunkSize); err != nil {
+		return nil, readError("chunk size", err)
+	}
+	if header.chunkSize == 0 || header.chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("%w: invalid chunk size: %d", ErrCorrupted, header.chunkSize)
+	}
+
+	layerCount := make([]byte, 1)
+	if _, err := io.ReadFull(reader, layerCount); err != nil {
+		return nil, readError("layer count", err)
+	}
+	if layerCount[0] == 0 || layerCount[0] > maxLayers {
+		return nil, fmt.Errorf("%w: invalid number of layers: %d", ErrCorrupted, layerCount[0])
+	}
+
+	for i := 0; i < int(layerCount[0]); i++ {
+		cipherID := make([]byte, 1)
+		if _, err := io.ReadFull(reader, cipherID); err != nil {
+			return nil, readError(fmt.Sprintf("layer %d cipher", i+1), err)
+		}
+		prefixSize := noncePrefixSize(cipherID[0])
+		if prefixSize == 0 {
+			return nil, fmt.Errorf("%w: unknown cipher %d", ErrUnsupportedVersion, cipherID[0])
+		}
+
+		layer := layerParams{cipher: cipherID[0], noncePrefix: make([]byte, prefixSize)}
+		if header.version == 2 {
+			layer.salt = make([]byte, 16)
+			if _, err := io.ReadFull(reader, layer.salt); err != nil {
+				return nil, readError(fmt.Sprintf("layer %d salt", i+1), err)
+			}
+		}
+		if _, err := io.ReadFull(reader, layer.noncePrefix); err != nil {
+			return nil, readError(fmt.Sprintf("layer %d nonce", i+1), err)
+		}
+		header.layers = append(header.layers, layer)
+	}
+
+	if header.version >= keyWrapVersion {
+		if err := header.readStanzas(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	header.raw = raw.Bytes()
+	return header, nil
+}
+
+// readStanzas reads the stanzas of a version 4 header.
+func (h *fileHeader) readStanzas(reader io.Reader) error {
+	count := make([]byte, 1)
+	if _, err := io.ReadFull(reader, count); err != nil {
+		return readError("stanza count", err)
+	}
+	if count[0] == 0 {
+		return fmt.Errorf("%w: no stanzas", ErrCorrupted)
+	}
+
+	for i := 0; i < int(count[0]); i++ {
+		var stanzaHeader struct {
+			Kind   byte
+			Length uint16
+		}
+		if err := binary.Read(reader, binary.BigEndian, &stanzaHeader); err != nil {
+			return readError(fmt.Sprintf("stanza %d", i+1), err)
+		}
+		size, known := stanzaSizes[stanzaHeader.Kind]
+		if !known {
+			return fmt.Errorf("%w: unknown stanza type %d", ErrUnsupportedVersion, stanzaHeader.Kind)
+		}
+		if int(stanzaHeader.Length) != size {
+			return fmt.Errorf("%w: invalid stanza length: %d", ErrCorrupted, stanzaHeader.Length)
+		}
+
+		stanza := keyStanza{kind: stanzaHeader.Kind, body: make([]byte, size)}
+		if _, err := io.ReadFull(reader, stanza.body); err != nil {
+			return readError(fmt.Sprintf("stanza %d", i+1), err)
+		}
+		if stanza.kind == stanzaPassword {
+			if _, err := parsePasswordStanza(stanza.body); err != nil {
+				return err
+			}
+		}
+		h.stanzas = append(h.stanzas, stanza)
+	}
+	return nil
+}
+
+// readKDF reads the KDF id and parameters and the master key salt of version 2 and 3 headers.
+func (h *fileHeader) readKDF(reader io.Reader) error {
+	id := make([]byte, 1)
+	if _, err := io.ReadFull(reader, id); err != nil {
+		return readError("KDF id", err)
+	}
+	h.kdf.id = id[0]
+	switch h.kdf.id {
+	case kdfPBKDF2SHA256:
+		if err := binary.Read(reader, binary.BigEndian, &h.kdf.iterations); err != nil {
+			return readError("KDF parameters", err)
+		}
+		if h.kdf.iterations == 0 {
+			return fmt.Errorf("%w: invalid PBKDF2 iteration count: 0", ErrCorrupted)
+		}
+	case kdfArgon2id:
+		params := &h.kdf.argon2
+		if err := binary.Read(reader, binary.BigEndian, params); err != nil {
+			return readError("KDF parameters", err)
+		}
+		// Older settings may be below today's minimum, only refuse values that cannot work or would hang
+		if params.Time == 0 || params.Time > maxKDFTime || params.Memory == 0 || params.Memory > maxKDFMemory || params.Threads == 0 {
+			return fmt.Errorf("%w: invalid Argon2id parameters: time %d, memory %d KiB, threads %d", ErrCorrupted, params.Time, params.Memory, params.Threads)
+		}
+	default:
+		return fmt.Errorf("%w: unknown KDF %d", ErrUnsupportedVersion, h.kdf.id)
+	}
+
+	if h.version >= 3 {
+		h.salt = make([]byte, 16)
+		if _, err := io.ReadFull(reader, h.salt); err != nil {
+			return readError("salt", err)
+		}
+	}
+	return nil
+}
+
+// deriveKey runs the KDF recorded in the header on the password and salt.
+func (h *fileHeader) deriveKey(password string, salt []byte) []byte {
+	if h.kdf.id == kdfArgon2id {
+		return deriveKeyArgon2id(password, salt, h.kdf.argon2)
+	}
+	return deriveKeyPBKDF2(password, salt, int(h.kdf.iterations))
+}
+
+// secrets holds everything a header may need to recover its keys.
+type secrets struct {
+	password   string
+	keyfile    []byte            // Key material from ReadKeyfile
+	identities []*X25519Identity // Tried on the stanzas of version 4 headers
+}
+
+// layerKeys returns the key of every layer. The KDF runs once for the master key and the layer keys
+// are expanded from it with HKDF. The keyfile material is mixed into the master key if the header
+// asks for it, and ignored otherwise. Version 2 headers ran the KDF for every layer with its own salt.
+// Version 4 headers use the file key unwrapped from one of the stanzas as the master key.
+func (h *fileHeader) layerKeys(s secrets) ([][]byte, error) {
+	keys := make([][]byte, len(h.layers))
+	if h.version == 2 {
+		for i, layer := range h.layers {
+			keys[i] = h.deriveKey(s.password, layer.salt)
+		}
+		return keys, nil
+	}
+
+	var masterKey []byte
+	if h.version >= keyWrapVersion {
+		fileKey, _, err := h.unwrapFileKey(s)
+		if err != nil {
+			return nil, err
+		}
+		masterKey = fileKey
+	} else {
+		masterKey = h.deriveKey(s.password, h.salt)
+		if h.flags&flagKeyfile != 0 {
+			if s.keyfile == nil {
+				return nil, ErrKeyfileRequired
+			}
+			masterKey = mixKeyfile(masterKey, s.keyfile)
+		}
+	}
+	for i := range h.layers {
+		key, err := expandLayerKey(masterKey, i)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// checksPassword reports whether the first chunk of the layer is the only check of the password, so
+// a first chunk that does not open means a wrong password rather than a damaged file. That holds for
+// the outermost layer of version 2 and 3 headers. Version 4 stanzas already proved the file key right.
+func (h *fileHeader) checksPassword(layer int) bool {
+	return layer == len(h.layers)-1 && h.version < keyWrapVersion
+}
+
+// unwrapFileKey returns the file key of a version 4 header and the index of the stanza that held it.
+// The identities are tried on the recipient stanzas and the password and keyfile on the key slots.
+// Every key slot runs the KDF, so a wrong password costs one run per slot.
+func (h *fileHeader) unwrapFileKey(s secrets) ([]byte, int, error) {
+	if h.fileKey != nil {
+		return h.fileKey, -1, nil
+	}
+
+	// Key slots are skipped when only identities are given, they cannot open them
+	trySlots := s.password != "" || s.keyfile != nil || len(s.identities) == 0
+	ad := h.associatedData()
+	var recipients, wrongPassword, keyfileMissing bool
+	for i, stanza := range h.stanzas {
+		switch stanza.kind {
+		case stanzaX25519:
+			recipients = true
+			for _, identity := range s.identities {
+				fileKey, err := identity.unwrap(stanza, ad)
+				if err == nil {
+					return fileKey, i, nil
+				}
+				if err != errStanzaMismatch {
+					return nil, 0, err
+				}
+			}
+		case stanzaPassword:
+			if !trySlots {
+				continue
+			}
+			slot, _ := parsePasswordStanza(stanza.body) // Checked by readStanzas
+			if slot.flags&slotKeyfile != 0 && s.keyfile == nil {
+				keyfileMissing = true
+				continue
+			}
+			slotSecrets := s
+			if slot.flags&slotRecovery != 0 {
+				// Only a well-formed recovery code can open it, anything else does not need the KDF
+				code, err := parseRecoveryCode(s.password)
+				if err != nil {
+					wrongPassword = true
+					continue
+				}
+				slotSecrets = secrets{password: code}
+			}
+			fileKey, err := slot.unwrap(slotSecrets, ad)
+			if err == nil {
+				return fileKey, i, nil
+			}
+			if err != errStanzaMismatch {
+				return nil, 0, err
+			}
+			wrongPassword = true
+		}
+	}
+
+	switch {
+	case wrongPassword:
+		return nil, 0, ErrWrongPassword
+	case keyfileMissing:
+		return nil, 0, ErrKeyfileRequired
+	case len(s.identities) > 0:
+		return nil, 0, ErrNoMatchingIdentity
+	case recipients:
+		return nil, 0, ErrIdentityRequired
+	default:
+		return nil, 0, ErrWrongPassword
+	}
+}
+
+// DetectFormat reports which GoCrypt format the data read from source is in, or FormatAge for age files.
+// Files with a header are recognised reliably, an unsupported header version is returned as ErrUnsupportedVersion.
+// Older files have no magic bytes, so they are only recognised by a guess on their first bytes.
+func DetectFormat(source io.Reader) (Format, error) {
+	format, _, err := detectFormat(source)
+	return format, err
+}
+
+// detectFormat works like DetectFormat and also returns a reader that yields the full data again, including the bytes inspected.
+func detectFormat(source io.Reader) (Format, io.Reader, error) {
+	start := make([]byte, len(headerMagic)+1) // Enough for the magic and version, or any legacy header byte
+	n, err := io.ReadFull(source, start)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return FormatUnknown, nil, err
+	}
+	complete := n == len(start)
+	start = start[:n]
+	reader := io.MultiReader(bytes.NewReader(start), source)
+
+	switch {
+	case complete && strings.HasPrefix(ageVersionLine+"\n", string(start)):
+		return FormatAge, reader, nil
+	case bytes.HasPrefix(start, headerMagic):
+		if !complete || start[len(headerMagic)] < minHeaderVersion || start[len(headerMagic)] > maxHeaderVersion {
+			return FormatHeader, reader, ErrUnsupportedVersion
+		}
+		return FormatHeader, reader, nil
+	case complete && start[0] == formatMarker && start[1] == markerVersion && start[2] >= 1 && start[2] <= maxLayers:
+		return FormatStream, reader, nil
+	case complete && start[0] >= 1 && start[0] <= maxLayers:
+		return FormatLegacy, reader, nil
+	default:
+		return FormatUnknown, reader, nil
+	}
+}
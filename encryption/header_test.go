@@ -0,0 +1,282 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// version3Header builds a header in the format written before key slots, where the master key is
+// derived from the password with the salt in the header
+func version3Header(tb testing.TB, opts Options) *fileHeader {
+	header, err := newFileHeader(opts, "testpassword")
+	if err != nil {
+		tb.Fatalf("Failed to create header: %v", err)
+	}
+	header.version = headerVersion
+	header.kdf = kdfParams{id: kdfArgon2id, argon2: opts.KDF}
+	header.salt, _ = GenerateSalt()
+	if opts.Keyfile != nil {
+		header.flags = flagKeyfile
+	}
+	header.stanzas, header.fileKey = nil, nil
+	header.raw = header.marshal()
+	return header
+}
+
+// TestHeaderRoundTrip tests that a marshalled header reads back unchanged
+func TestHeaderRoundTrip(t *testing.T) {
+	header, err := newFileHeader(DefaultOptions(3), "testpassword")
+	if err != nil {
+		t.Fatalf("Failed to create header: %v", err)
+	}
+
+	parsed, err := readHeader(bytes.NewReader(header.raw))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if !bytes.Equal(parsed.raw, header.raw) {
+		t.Errorf("Raw header mismatch after reading it back")
+	}
+	if parsed.chunkSize != chunkSize || len(parsed.layers) != 3 || len(parsed.stanzas) != 1 || !bytes.Equal(parsed.stanzas[0].body, header.stanzas[0].body) {
+		t.Errorf("Header fields mismatch: %+v", parsed)
+	}
+}
+
+// TestHeaderChunkSize tests that the chunk size option is recorded in the header and checked
+func TestHeaderChunkSize(t *testing.T) {
+	for _, size := range []int{minChunkSize, 1024 * 1024, maxChunkSize} {
+		opts := DefaultOptions(1)
+		opts.ChunkSize = size
+		header, err := newFileHeader(opts, "testpassword")
+		if err != nil {
+			t.Fatalf("Failed to create header with chunk size %d: %v", size, err)
+		}
+		parsed, err := readHeader(bytes.NewReader(header.raw))
+		if err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+		if parsed.chunkSize != uint32(size) {
+			t.Errorf("Expected chunk size %d, got %d", size, parsed.chunkSize)
+		}
+	}
+
+	for _, size := range []int{0, minChunkSize - 1, maxChunkSize + 1} {
+		opts := DefaultOptions(1)
+		opts.ChunkSize = size
+		if _, err := newFileHeader(opts, "testpassword"); err == nil {
+			t.Errorf("Expected chunk size %d to be refused", size)
+		}
+	}
+}
+
+// TestReadHeaderRejectsUnknown tests that headers with unknown versions or values are refused
+func TestReadHeaderRejectsUnknown(t *testing.T) {
+	header := version3Header(t, testOptions(1))
+
+	versionOffset := len(headerMagic)
+	chunkSizeOffset := versionOffset + 12 + len(header.salt)
+	tests := map[string]func(raw []byte){
+		"version":    func(raw []byte) { raw[versionOffset] = maxHeaderVersion + 1 },
+		"flags":      func(raw []byte) { raw[versionOffset+1] = 0x80 },
+		"kdf":        func(raw []byte) { raw[versionOffset+2] = 0xff },
+		"magic":      func(raw []byte) { raw[0] = 'X' },
+		"kdf time":   func(raw []byte) { copy(raw[versionOffset+3:], []byte{0, 0, 0, 0}) },
+		"chunk size": func(raw []byte) { copy(raw[chunkSizeOffset:], []byte{0, 0, 0, 0}) },
+		"layers":     func(raw []byte) { raw[chunkSizeOffset+4] = 0 },
+	}
+	for name, tamper := range tests {
+		raw := bytes.Clone(header.raw)
+		tamper(raw)
+		if _, err := readHeader(bytes.NewReader(raw)); err == nil {
+			t.Errorf("Expected header with modified %s to be refused", name)
+		}
+	}
+}
+
+// TestDetectFormat tests format detection for headers, legacy files and plain data
+func TestDetectFormat(t *testing.T) {
+	header, err := newFileHeader(testOptions(1), "testpassword")
+	if err != nil {
+		t.Fatalf("Failed to create header: %v", err)
+	}
+	unsupported := bytes.Clone(header.raw)
+	unsupported[len(headerMagic)] = maxHeaderVersion + 1
+
+	tests := []struct {
+		name    string
+		data    []byte
+		format  Format
+		wantErr bool
+	}{
+		{"header", header.raw, FormatHeader, false},
+		{"unsupported version", unsupported, FormatHeader, true},
+		{"stream", append([]byte{formatMarker, markerVersion, 5}, make([]byte, 40)...), FormatStream, false},
+		{"legacy", append([]byte{5}, make([]byte, 40)...), FormatLegacy, false},
+		{"plain text", []byte("\x00\x00 not encrypted at all"), FormatUnknown, false},
+		{"empty", nil, FormatUnknown, false},
+	}
+	for _, test := range tests {
+		format, err := DetectFormat(bytes.NewReader(test.data))
+		if format != test.format || (err != nil) != test.wantErr {
+			t.Errorf("%s: got format %d, error %v", test.name, format, err)
+		}
+	}
+}
+
+// TestDecryptTamperedHeader tests that changing the header makes decryption fail
+func TestDecryptTamperedHeader(t *testing.T) {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	testFilePath := filepath.Join(workingDir, "test_header.txt")
+	key := "testpassword"
+	if err := os.WriteFile(testFilePath, []byte("This is a test file for encryption."), 0644); err != nil {
+		t.Fatalf("Failed to create test input file: %v", err)
+	}
+	defer os.Remove(testFilePath)
+
+	encryptedFilePath, err := EncryptTestFile(testFilePath, key, 2)
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	defer os.Remove(encryptedFilePath)
+
+	// Flip a bit in the nonce prefix of the innermost layer, the outermost layer only notices it through the associated data
+	data, err := os.ReadFile(encryptedFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	header, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	outerLayer := header.layers[1]
+	data[len(header.associatedData())-1-len(outerLayer.noncePrefix)-1] ^= 0x01
+	if err := os.WriteFile(encryptedFilePath, data, 0644); err != nil {
+		t.Fatalf("Failed to write tampered file: %v", err)
+	}
+
+	if _, err := DecryptTestFile(encryptedFilePath, key); err == nil {
+		t.Fatalf("Expected decryption to fail with a tampered header")
+	}
+}
+
+// TestDecryptVersion2File tests that files with a KDF run for every layer can still be decrypted
+func TestDecryptVersion2File(t *testing.T) {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	// Build a version 2 header, where every layer has its own salt
+	key := "testpassword"
+	header := &fileHeader{
+		version:   2,
+		kdf:       kdfParams{id: kdfArgon2id, argon2: KDFParams{Time: 1, Memory: minKDFMemory, Threads: 1}},
+		chunkSize: chunkSize,
+	}
+	for i := 0; i < 2; i++ {
+		salt, _ := GenerateSalt()
+		noncePrefix := make([]byte, noncePrefixSize(cipherXChaCha20Poly1305))
+		rand.Read(noncePrefix)
+		header.layers = append(header.layers, layerParams{cipher: cipherXChaCha20Poly1305, salt: salt, noncePrefix: noncePrefix})
+	}
+	header.raw = header.marshal()
+
+	keys, err := header.layerKeys(secrets{password: key})
+	if err != nil {
+		t.Fatalf("Failed to derive layer keys: %v", err)
+	}
+	if bytes.Equal(keys[0], keys[1]) {
+		t.Fatalf("Expected every layer to have its own key")
+	}
+
+	originalData := make([]byte, 2*chunkSize+10)
+	rand.Read(originalData)
+	payload := originalData
+	for i, layer := range header.layers {
+		aead, _ := newAEAD(layer.cipher, keys[i])
+		var sealed bytes.Buffer
+		if err := sealStream(aead, layer.noncePrefix, chunkSize, header.raw, bytes.NewReader(payload), &sealed); err != nil {
+			t.Fatalf("Failed to seal layer %d: %v", i+1, err)
+		}
+		payload = sealed.Bytes()
+	}
+
+	encryptedFilePath := filepath.Join(workingDir, "test_v2.enc")
+	if err := os.WriteFile(encryptedFilePath, append(bytes.Clone(header.raw), payload...), 0644); err != nil {
+		t.Fatalf("Failed to write version 2 file: %v", err)
+	}
+	defer os.Remove(encryptedFilePath)
+
+	decryptedFilePath, err := DecryptTestFile(encryptedFilePath, key)
+	if err != nil {
+		t.Fatalf("Decryption of version 2 file failed: %v", err)
+	}
+	defer os.Remove(decryptedFilePath)
+
+	decryptedData, err := os.ReadFile(decryptedFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	if !bytes.Equal(originalData, decryptedData) {
+		t.Errorf("Decrypted version 2 data does not match the original")
+	}
+}
+
+// TestDecryptVersion3File tests that files whose master key is derived from the password, with or
+// without a keyfile, can still be decrypted
+func TestDecryptVersion3File(t *testing.T) {
+	key := "testpassword"
+	keyfile := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := make([]byte, 2*chunkSize+10)
+	rand.Read(plaintext)
+
+	for _, withKeyfile := range []bool{false, true} {
+		opts := testOptions(2)
+		if withKeyfile {
+			opts.Keyfile = keyfile
+		}
+		header := version3Header(t, opts)
+		keys, err := header.layerKeys(secrets{password: key, keyfile: opts.Keyfile})
+		if err != nil {
+			t.Fatalf("Failed to derive layer keys: %v", err)
+		}
+		// There is no writer for version 3 anymore, so the layers are sealed under the header directly
+		var payload bytes.Buffer
+		writer, err := newLayeredWriter(&payload, header, keys, 1)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		if _, err := writer.Write(plaintext); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		ciphertext := append(bytes.Clone(header.raw), payload.Bytes()...)
+
+		reader, err := NewDecryptReaderWithOptions(bytes.NewReader(ciphertext), key, DecryptOptions{Keyfile: opts.Keyfile})
+		if err != nil {
+			t.Fatalf("Keyfile %v: failed to open version 3 file: %v", withKeyfile, err)
+		}
+		decrypted, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Keyfile %v: decryption of version 3 file failed: %v", withKeyfile, err)
+		}
+		want := ErrWrongPassword
+		if withKeyfile {
+			want = ErrKeyfileRequired
+		}
+		if _, err := decryptTestData(ciphertext, "otherpassword", DecryptOptions{}); !errors.Is(err, want) {
+			t.Errorf("Keyfile %v: expected %v, got %v", withKeyfile, want, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package encryption
+
+// chunkTask is a chunk being sealed or opened by a worker.
+type chunkTask struct {
+	in    []byte // Chunk to seal or open
+	out   []byte // Result, valid once done is closed
+	nonce []byte // Nonce of the chunk, including the last-chunk flag
+	last  bool   // The chunk is the final one of the stream
+	err   error  // Error from processing the chunk
+	done  chan struct{}
+}
+
+// chunkPipeline seals or opens up to workers chunks at the same time and hands the results back
+// in the order the chunks were started, so the output is the same as processing them one by one.
+// Every chunk runs on its own goroutine, a pipeline that is abandoned half way leaves nothing behind
+// once its chunks are done. Buffers of finished chunks are reused, so a pipeline holds at most
+// workers+1 input and output buffers: the pending chunks and the one being filled or read.
+type chunkPipeline struct {
+	workers   int
+	inSize    int // Capacity of the input buffers
+	outSize   int // Capacity of the output buffers
+	nonceSize int
+	process   func(task *chunkTask)
+	pending   []*chunkTask // Started chunks, oldest first
+	free      []*chunkTask // Finished chunks whose buffers can be reused
+}
+
+// newChunkPipeline creates a pipeline that runs process on up to workers chunks at the same time.
+func newChunkPipeline(workers, inSize, outSize, nonceSize int, process func(task *chunkTask)) *chunkPipeline {
+	return &chunkPipeline{workers: workers, inSize: inSize, outSize: outSize, nonceSize: nonceSize, process: process}
+}
+
+// task returns a chunk with empty buffers, ready to be filled and started.
+func (p *chunkPipeline) task() *chunkTask {
+	if n := len(p.free); n > 0 {
+		task := p.free[n-1]
+		p.free = p.free[:n-1]
+		task.in, task.out, task.last, task.err = task.in[:0], task.out[:0], false, nil
+		return task
+	}
+	return &chunkTask{
+		in:    make([]byte, 0, p.inSize),
+		out:   make([]byte, 0, p.outSize),
+		nonce: make([]byte, p.nonceSize),
+	}
+}
+
+// start processes the chunk in the background.
+func (p *chunkPipeline) start(task *chunkTask) {
+	task.done = make(chan struct{})
+	p.pending = append(p.pending, task)
+	go func() {
+		defer close(task.done)
+		p.process(task)
+	}()
+}
+
+// full reports whether every worker is busy, wait must be called before starting another chunk.
+func (p *chunkPipeline) full() bool {
+	return len(p.pending) >= p.workers
+}
+
+// empty reports whether no chunk is pending.
+func (p *chunkPipeline) empty() bool {
+	return len(p.pending) == 0
+}
+
+// wait returns the oldest pending chunk once it is processed. Its buffers stay valid until it is released.
+func (p *chunkPipeline) wait() *chunkTask {
+	task := p.pending[0]
+	p.pending = p.pending[1:]
+	<-task.done
+	return task
+}
+
+// release hands the buffers of a finished chunk back for reuse.
+func (p *chunkPipeline) release(task *chunkTask) {
+	p.free = append(p.free, task)
+}
@@ -0,0 +1,109 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// TestParallelMatchesSerial tests that sealing and opening chunks in parallel matches doing it one by one.
+// Every chunk has a fixed nonce, so output that the serial reader opens and that is as long as the
+// serial output is byte-identical to what serial sealing would have written under the same header.
+func TestParallelMatchesSerial(t *testing.T) {
+	key := "testpassword"
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 5 * chunkSize, 7*chunkSize + 3}
+	for _, layers := range []int{1, 3} {
+		for _, size := range sizes {
+			plaintext := make([]byte, size)
+			rand.Read(plaintext)
+			expected := len(encryptTestData(t, key, plaintext, testOptions(layers)))
+
+			for _, workers := range []int{2, 3, 8} {
+				name := fmt.Sprintf("%d layers, %d bytes, %d workers", layers, size, workers)
+				opts := testOptions(layers)
+				opts.Workers = workers
+				ciphertext := encryptTestData(t, key, plaintext, opts)
+				if len(ciphertext) != expected {
+					t.Errorf("%s: expected %d bytes like the serial output, got %d", name, expected, len(ciphertext))
+				}
+
+				for _, readers := range []int{1, workers} {
+					decrypted, err := decryptTestData(ciphertext, key, DecryptOptions{Workers: readers})
+					if err != nil {
+						t.Errorf("%s: decryption with %d workers failed: %v", name, readers, err)
+					} else if !bytes.Equal(plaintext, decrypted) {
+						t.Errorf("%s: plaintext mismatch with %d workers", name, readers)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestParallelDecryptErrors tests that parallel decryption reports failures like serial decryption
+func TestParallelDecryptErrors(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 6*chunkSize)
+	rand.Read(plaintext)
+	ciphertext := encryptTestData(t, key, plaintext, testOptions(2))
+
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	sealedChunk := chunkSize + 16
+	corrupted := bytes.Clone(ciphertext)
+	corrupted[len(header.raw)+3*sealedChunk+10] ^= 0x01
+
+	tests := []struct {
+		name     string
+		data     []byte
+		password string
+		want     error
+	}{
+		{"wrong password", ciphertext, "otherpassword", ErrWrongPassword},
+		{"corrupted chunk", corrupted, key, ErrCorrupted},
+		{"truncated on a chunk boundary", ciphertext[:len(header.raw)+2*sealedChunk], key, ErrTruncated},
+		{"appended data", append(bytes.Clone(ciphertext), make([]byte, sealedChunk)...), key, ErrCorrupted},
+	}
+	for _, test := range tests {
+		reader, err := NewDecryptReaderWithOptions(bytes.NewReader(test.data), test.password, DecryptOptions{Workers: 4})
+		if err == nil {
+			_, err = io.ReadAll(reader)
+		}
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+}
+
+// TestParallelMemory tests that the layers share the workers, so many layers with several workers
+// allocate buffers for about workers+layers chunks rather than workers chunks for every layer
+func TestParallelMemory(t *testing.T) {
+	const layers, workers = 16, 8
+	plaintext := make([]byte, 64*chunkSize)
+	rand.Read(plaintext)
+	ciphertext := encryptTestData(t, "testpassword", plaintext, testOptions(layers))
+
+	reader, err := NewDecryptReaderWithOptions(bytes.NewReader(ciphertext), "testpassword", DecryptOptions{Workers: workers})
+	if err != nil {
+		t.Fatalf("Failed to create decrypt reader: %v", err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := io.Copy(io.Discard, reader)
+	runtime.ReadMemStats(&after)
+	if err != nil || n != int64(len(plaintext)) {
+		t.Fatalf("Decryption failed after %d bytes: %v", n, err)
+	}
+
+	// Every chunk in flight holds a sealed and an opened buffer
+	limit := uint64(4 * (workers + layers) * chunkSize)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > limit {
+		t.Errorf("Expected at most %d bytes allocated while decrypting, got %d", limit, allocated)
+	}
+}
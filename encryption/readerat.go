@@ -0,0 +1,232 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DecryptReaderAt gives random access to the plaintext of an encrypted file. Only the chunks
+// covering the requested range are read and decrypted, so a small range of a large file is cheap.
+// It is safe for parallel ReadAt calls. Files without a header do not record their chunk size
+// and have to be decrypted in full with NewDecryptReader.
+type DecryptReaderAt struct {
+	plaintext *chunkReaderAt // Innermost layer
+}
+
+// NewDecryptReaderAt opens the encrypted file of the given size in source for random access.
+// The key is derived and the first and last chunk of every layer are checked straight away, so
+// a wrong password, a truncated file or appended data is reported here rather than on a later read.
+func NewDecryptReaderAt(source io.ReaderAt, size int64, password string) (*DecryptReaderAt, error) {
+	return NewDecryptReaderAtWithOptions(source, size, password, DecryptOptions{})
+}
+
+// NewDecryptReaderAtWithOptions works like NewDecryptReaderAt and takes the keyfile and identities from opts.
+// The chunks are always opened one at a time, opts.Workers is ignored.
+func NewDecryptReaderAtWithOptions(source io.ReaderAt, size int64, password string, opts DecryptOptions) (*DecryptReaderAt, error) {
+	format, reader, err := detectFormat(io.NewSectionReader(source, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatHeader:
+	case FormatAge:
+		plaintext, err := newAgeReaderAt(source, size, opts.secrets(password))
+		if err != nil {
+			return nil, err
+		}
+		return &DecryptReaderAt{plaintext: plaintext}, nil
+	case FormatStream, FormatLegacy:
+		return nil, fmt.Errorf("random access needs a file with a header, decrypt older files in full")
+	default:
+		return nil, ErrNotGoCrypt
+	}
+
+	header, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := header.layerKeys(opts.secrets(password))
+	if err != nil {
+		return nil, err
+	}
+
+	// Every layer reads its ciphertext from the layer around it, the outermost one from the file
+	headerSize := int64(len(header.raw))
+	var layerSource io.ReaderAt = io.NewSectionReader(source, headerSize, size-headerSize)
+	layerSize := size - headerSize
+	var layer *chunkReaderAt
+	for i := len(header.layers) - 1; i >= 0; i-- {
+		params := header.layers[i]
+		aead, err := newAEAD(params.cipher, keys[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AEAD: %v", err)
+		}
+		layer, err = newChunkReaderAt(layerSource, layerSize, aead, params.noncePrefix, int(header.chunkSize), header.associatedData(), i+1, header.checksPassword(i))
+		if err != nil {
+			return nil, err
+		}
+		layerSource, layerSize = layer, layer.size
+	}
+	return &DecryptReaderAt{plaintext: layer}, nil
+}
+
+// ReadAt decrypts len(p) bytes of plaintext starting at off. It returns io.EOF when the
+// range reaches past the end of the plaintext.
+func (r *DecryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.plaintext.ReadAt(p, off)
+}
+
+// Size returns the length of the plaintext.
+func (r *DecryptReaderAt) Size() int64 {
+	return r.plaintext.size
+}
+
+// ReadSeeker returns an io.ReadSeeker over the plaintext, with its own offset.
+func (r *DecryptReaderAt) ReadSeeker() io.ReadSeeker {
+	return io.NewSectionReader(r, 0, r.Size())
+}
+
+// chunkReaderAt decrypts single chunks of one layer, whose chunks are stored back to back in source.
+// The plaintext of the last chunk opened is kept, so reading a chunk piece by piece opens it once.
+type chunkReaderAt struct {
+	source io.ReaderAt
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte // Associated data authenticated with every chunk
+	layer  int    // Layer number used in error messages
+	chunk  int    // Plaintext bytes in a full chunk
+	chunks int64  // Number of chunks, including the final one
+	length int64  // Length of the ciphertext
+	size   int64  // Length of the plaintext
+
+	mu        sync.Mutex
+	cached    int64  // Index of the chunk in plaintext, -1 if none
+	plaintext []byte // Plaintext of the cached chunk
+	sealed    []byte // Buffer to hold ciphertext (plaintext + MAC)
+}
+
+// newChunkReaderAt works out the chunk layout of the layer from the length of its ciphertext and
+// checks its first and final chunk. A first chunk that does not open means a wrong password if
+// outer is set, see fileHeader.checksPassword.
+func newChunkReaderAt(source io.ReaderAt, sourceSize int64, aead cipher.AEAD, prefix []byte, chunk int, ad []byte, layer int, outer bool) (*chunkReaderAt, error) {
+	if len(prefix) != aead.NonceSize()-streamSuffixSize {
+		return nil, fmt.Errorf("invalid nonce prefix length: %d", len(prefix))
+	}
+	r := &chunkReaderAt{
+		source: source,
+		aead:   aead,
+		prefix: prefix,
+		ad:     ad,
+		layer:  layer,
+		chunk:  chunk,
+		length: sourceSize,
+		cached: -1,
+		sealed: make([]byte, chunk+aead.Overhead()),
+	}
+
+	// Every chunk is full except the final one, which holds at least its tag, and some plaintext
+	// too unless it is the only chunk
+	sealedSize := int64(len(r.sealed))
+	if sourceSize < int64(aead.Overhead()) {
+		return nil, r.wrap(ErrTruncated)
+	}
+	r.chunks = (sourceSize + sealedSize - 1) / sealedSize
+	if final := sourceSize - (r.chunks-1)*sealedSize; final < int64(aead.Overhead()) || r.chunks > 1 && final == int64(aead.Overhead()) {
+		return nil, r.wrap(fmt.Errorf("%w: invalid length", ErrCorrupted))
+	}
+	if r.chunks > 1<<32 {
+		return nil, r.wrap(fmt.Errorf("%w: too many chunks", ErrCorrupted))
+	}
+	r.size = sourceSize - r.chunks*int64(aead.Overhead())
+
+	if err := r.open(0, outer); err != nil {
+		return nil, err
+	}
+	if err := r.open(r.chunks-1, false); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadAt decrypts len(p) bytes of the layer's plaintext starting at off.
+func (r *chunkReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) && off < r.size {
+		index := off / int64(r.chunk)
+		if err := r.open(index, false); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], r.plaintext[off-index*int64(r.chunk):])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// open decrypts the chunk at index into the cache, the caller must hold the lock unless the reader
+// is not shared yet. first marks the very first chunk read from the file.
+func (r *chunkReaderAt) open(index int64, first bool) error {
+	if index == r.cached {
+		return nil
+	}
+	r.cached = -1
+
+	sealedSize := int64(len(r.sealed))
+	sealed := r.sealed[:min(sealedSize, r.length-index*sealedSize)]
+	if _, err := r.source.ReadAt(sealed, index*sealedSize); err != nil && err != io.EOF {
+		return r.wrap(readError("encrypted data", err))
+	}
+
+	last := index == r.chunks-1
+	nonce := r.nonce(index, last)
+	plaintext, err := r.aead.Open(r.plaintext[:0], nonce, sealed, r.ad)
+	if err != nil {
+		return r.wrap(r.openError(sealed, nonce, last, first))
+	}
+	r.plaintext = plaintext
+	r.cached = index
+	return nil
+}
+
+// nonce builds the STREAM nonce of the chunk at index.
+func (r *chunkReaderAt) nonce(index int64, last bool) []byte {
+	nonce := make([]byte, r.aead.NonceSize())
+	copy(nonce, r.prefix)
+	binary.BigEndian.PutUint32(nonce[len(r.prefix):], uint32(index))
+	setLastChunk(nonce, last)
+	return nonce
+}
+
+// openError works out why a chunk did not open, like streamReader.openError. A full final chunk
+// that opens without the last-chunk flag means the layer was cut on a chunk boundary, a chunk before
+// it that opens with the flag means it is followed by data that was appended.
+func (r *chunkReaderAt) openError(sealed, nonce []byte, last, first bool) error {
+	if len(sealed) == len(r.sealed) {
+		setLastChunk(nonce, !last)
+		_, err := r.aead.Open(nil, nonce, sealed, r.ad)
+		if err == nil && last {
+			return ErrTruncated
+		}
+		if err == nil {
+			return fmt.Errorf("%w: data after the final chunk", ErrCorrupted)
+		}
+	}
+	return authError(first, false)
+}
+
+// wrap adds the layer number to errors about this layer.
+func (r *chunkReaderAt) wrap(err error) error {
+	return fmt.Errorf("layer %d decryption failed: %w", r.layer, err)
+}
@@ -0,0 +1,175 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestDecryptReaderAtRanges tests that any range of the plaintext can be read on its own
+func TestDecryptReaderAtRanges(t *testing.T) {
+	key := "testpassword"
+	size := minChunkSize
+	for _, layers := range []int{1, 3} {
+		for _, length := range []int{0, 1, size, 5*size + 17} {
+			plaintext := make([]byte, length)
+			rand.Read(plaintext)
+			opts := testOptions(layers)
+			opts.ChunkSize = size
+			ciphertext := encryptTestData(t, key, plaintext, opts)
+
+			reader, err := NewDecryptReaderAt(bytes.NewReader(ciphertext), int64(len(ciphertext)), key)
+			if err != nil {
+				t.Fatalf("%d layers, %d bytes: failed to open: %v", layers, length, err)
+			}
+			if reader.Size() != int64(length) {
+				t.Errorf("%d layers: expected size %d, got %d", layers, length, reader.Size())
+			}
+
+			// Ranges inside a chunk, across chunk boundaries and up to the end
+			for _, r := range [][2]int{{0, length}, {0, 1}, {size - 3, 7}, {size, size}, {2*size + 5, 3 * size}, {length - 1, 1}} {
+				offset, count := r[0], r[1]
+				if offset < 0 || offset+count > length {
+					continue
+				}
+				buffer := make([]byte, count)
+				if n, err := reader.ReadAt(buffer, int64(offset)); err != nil && !(err == io.EOF && n == count) {
+					t.Errorf("%d layers: ReadAt(%d, %d) failed: %v", layers, offset, count, err)
+				} else if !bytes.Equal(buffer, plaintext[offset:offset+count]) {
+					t.Errorf("%d layers: ReadAt(%d, %d) returned the wrong data", layers, offset, count)
+				}
+			}
+
+			// Reading past the end returns what is left and io.EOF
+			buffer := make([]byte, 10)
+			if n, err := reader.ReadAt(buffer, int64(length)-min(int64(length), 4)); err != io.EOF || n != min(length, 4) {
+				t.Errorf("%d layers, %d bytes: expected %d bytes and io.EOF at the end, got %d and %v", layers, length, min(length, 4), n, err)
+			}
+		}
+	}
+}
+
+// TestDecryptReaderAtSeeker tests seeking and reading through the io.ReadSeeker
+func TestDecryptReaderAtSeeker(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+	ciphertext := encryptTestData(t, key, plaintext, testOptions(2))
+
+	reader, err := NewDecryptReaderAt(bytes.NewReader(ciphertext), int64(len(ciphertext)), key)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	seeker := reader.ReadSeeker()
+	if _, err := seeker.Seek(chunkSize+10, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	rest, err := io.ReadAll(seeker)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(rest, plaintext[chunkSize+10:]) {
+		t.Errorf("Data after seeking does not match")
+	}
+}
+
+// TestDecryptReaderAtParallel tests parallel ReadAt calls on the same reader
+func TestDecryptReaderAtParallel(t *testing.T) {
+	key := "testpassword"
+	plaintext := make([]byte, 20*minChunkSize)
+	rand.Read(plaintext)
+	opts := testOptions(2)
+	opts.ChunkSize = minChunkSize
+	ciphertext := encryptTestData(t, key, plaintext, opts)
+
+	reader, err := NewDecryptReaderAt(bytes.NewReader(ciphertext), int64(len(ciphertext)), key)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			buffer := make([]byte, 3*minChunkSize)
+			for ; offset+len(buffer) <= len(plaintext); offset += 2 * minChunkSize {
+				if _, err := reader.ReadAt(buffer, int64(offset)); err != nil {
+					t.Errorf("ReadAt(%d) failed: %v", offset, err)
+					return
+				}
+				if !bytes.Equal(buffer, plaintext[offset:offset+len(buffer)]) {
+					t.Errorf("ReadAt(%d) returned the wrong data", offset)
+				}
+			}
+		}(worker * 100)
+	}
+	wg.Wait()
+}
+
+// TestDecryptReaderAtErrors tests that damaged files and wrong passwords are reported like in a full decryption
+func TestDecryptReaderAtErrors(t *testing.T) {
+	key := "testpassword"
+	size := minChunkSize
+	plaintext := make([]byte, 8*size)
+	rand.Read(plaintext)
+	opts := testOptions(2)
+	opts.ChunkSize = size
+	ciphertext := encryptTestData(t, key, plaintext, opts)
+
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	sealedChunk := size + 16
+	open := func(data []byte, password string) (*DecryptReaderAt, error) {
+		return NewDecryptReaderAt(bytes.NewReader(data), int64(len(data)), password)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		password string
+		want     error
+	}{
+		{"wrong password", ciphertext, "otherpassword", ErrWrongPassword},
+		{"truncated on a chunk boundary", ciphertext[:len(header.raw)+3*sealedChunk], key, ErrTruncated},
+		{"appended chunk", append(bytes.Clone(ciphertext), make([]byte, sealedChunk)...), key, ErrCorrupted},
+		{"appended bytes", append(bytes.Clone(ciphertext), 1, 2, 3), key, ErrCorrupted},
+		{"plain data", []byte("\x00\x00 not encrypted at all"), key, ErrNotGoCrypt},
+	}
+	for _, test := range tests {
+		if _, err := open(test.data, test.password); !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+
+	// A damaged chunk in the middle only fails the reads that cover it
+	corrupted := bytes.Clone(ciphertext)
+	corrupted[len(header.raw)+4*sealedChunk+10] ^= 0x01
+	reader, err := open(corrupted, key)
+	if err != nil {
+		t.Fatalf("Failed to open file with a damaged middle chunk: %v", err)
+	}
+	buffer := make([]byte, size)
+	if _, err := reader.ReadAt(buffer, 0); err != nil {
+		t.Errorf("Expected the first chunk to read, got %v", err)
+	}
+	if _, err := reader.ReadAt(buffer, 4*int64(size)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted for the damaged chunk, got %v", err)
+	}
+
+	// Files without a header cannot be read at random
+	legacyPath := filepath.Join(t.TempDir(), "legacy.enc")
+	if err := writeLegacyTestFile(legacyPath, key, plaintext, 1); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+	legacy, _ := os.ReadFile(legacyPath)
+	if _, err := open(legacy, key); err == nil {
+		t.Errorf("Expected a legacy file to be refused")
+	}
+}
@@ -0,0 +1,90 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// recoveryKeySize is the number of random bytes in a recovery code (160 bits).
+	recoveryKeySize = 20
+
+	// recoveryChecksumSize is the number of SHA-256 bytes appended to catch typing mistakes.
+	recoveryChecksumSize = 5
+
+	// recoveryGroupSize is the number of characters between the dashes of a recovery code.
+	recoveryGroupSize = 5
+)
+
+// recoveryKDF are the Argon2id parameters of recovery slots. The code is random and long enough that
+// guessing it is out of reach however fast the KDF is, so the cheapest accepted setting is used.
+var recoveryKDF = KDFParams{Time: 1, Memory: minKDFMemory, Threads: 1}
+
+// errInvalidRecoveryCode is returned for text that is not a recovery code, or one with a typo.
+var errInvalidRecoveryCode = errors.New("invalid recovery code")
+
+// GenerateRecoveryCode returns a new random recovery code, such as
+// "ABCDE-FGHIJ-KLMNO-PQRST-UVWXY-Z2345-67ABC-DEFGH": 160 random bits and a checksum in 8 groups of
+// base32. Set it as Options.RecoveryCode to add a key slot that it opens, then show it to the user
+// once: it is not stored anywhere and cannot be recovered.
+func GenerateRecoveryCode() (string, error) {
+	key := make([]byte, recoveryKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %v", err)
+	}
+	return formatRecoveryCode(key), nil
+}
+
+// formatRecoveryCode encodes the key and its checksum in dash separated groups.
+func formatRecoveryCode(key []byte) string {
+	sum := sha256.Sum256(key)
+	encoded := base32.StdEncoding.EncodeToString(append(key[:recoveryKeySize:recoveryKeySize], sum[:recoveryChecksumSize]...))
+
+	var groups []string
+	for i := 0; i < len(encoded); i += recoveryGroupSize {
+		groups = append(groups, encoded[i:i+recoveryGroupSize])
+	}
+	return strings.Join(groups, "-")
+}
+
+// parseRecoveryCode returns the canonical form of a recovery code as typed by the user. Case, dashes
+// and spaces do not matter, and the digits 0 and 1 are read as the letters O and I they look like.
+func parseRecoveryCode(code string) (string, error) {
+	var normalized strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		switch {
+		case r == '-' || unicode.IsSpace(r):
+		case r == '0':
+			normalized.WriteByte('O')
+		case r == '1':
+			normalized.WriteByte('I')
+		default:
+			normalized.WriteRune(r)
+		}
+	}
+	data, err := base32.StdEncoding.DecodeString(normalized.String())
+	if err != nil || len(data) != recoveryKeySize+recoveryChecksumSize {
+		return "", errInvalidRecoveryCode
+	}
+	sum := sha256.Sum256(data[:recoveryKeySize])
+	if subtle.ConstantTimeCompare(sum[:recoveryChecksumSize], data[recoveryKeySize:]) != 1 {
+		return "", errInvalidRecoveryCode
+	}
+	return formatRecoveryCode(data[:recoveryKeySize]), nil
+}
+
+// wrapRecovery seals the file key in a recovery slot that the recovery code opens. The canonical
+// form of the code takes the place of the password.
+func wrapRecovery(fileKey, ad []byte, code string) (keyStanza, error) {
+	canonical, err := parseRecoveryCode(code)
+	if err != nil {
+		return keyStanza{}, err
+	}
+	return wrapPassword(fileKey, ad, PasswordSlot{Password: canonical, KDF: recoveryKDF}, slotRecovery)
+}
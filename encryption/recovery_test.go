@@ -0,0 +1,147 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestRecoveryCode tests the format of recovery codes and how forgiving parsing them is
+func TestRecoveryCode(t *testing.T) {
+	code, err := GenerateRecoveryCode()
+	if err != nil {
+		t.Fatalf("Failed to generate recovery code: %v", err)
+	}
+	if !regexp.MustCompile(`^[A-Z2-7]{5}(-[A-Z2-7]{5}){7}$`).MatchString(code) {
+		t.Errorf("Unexpected recovery code format: %s", code)
+	}
+	if other, _ := GenerateRecoveryCode(); other == code {
+		t.Errorf("Expected recovery codes to differ")
+	}
+
+	key := make([]byte, recoveryKeySize)
+	for i := range key {
+		key[i] = byte(i * 13)
+	}
+	want := "AAGRU-JZUIF-HFW2D-VQKHZ-ZKNWY-PIN32-XXOQX-CCZ6K"
+	if code := formatRecoveryCode(key); code != want {
+		t.Fatalf("Expected %s, got %s", want, code)
+	}
+
+	tests := []struct {
+		input string
+		valid bool
+	}{
+		{want, true},
+		{"aagru-jzuif-hfw2d-vqkhz-zknwy-pin32-xxoqx-ccz6k", true},
+		{"AAGRU JZU1F HFW2D VQKHZ ZKNWY P1N32 XX0QX CCZ6K", true},
+		{"AAGRUJZUIFHFW2DVQKHZZKNWYPIN32XXOQXCCZ6K\n", true},
+		{"AAGRU-JZUIF-HFW2D-VQKHZ-ZKNWY-PIN32-XXOQX-CCZ6L", false}, // Typo in the checksum
+		{"AAGRU-JZUIF-HFW2D-VQKHZ-ZKNWY-PIN32-XXOQX-CCZ6", false},  // Missing character
+		{"BAGRU-JZUIF-HFW2D-VQKHZ-ZKNWY-PIN32-XXOQX-CCZ6K", false}, // Typo in the key
+		{"testpassword", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		canonical, err := parseRecoveryCode(test.input)
+		if test.valid && (err != nil || canonical != want) {
+			t.Errorf("%q: expected %s, got %q: %v", test.input, want, canonical, err)
+		}
+		if !test.valid && !errors.Is(err, errInvalidRecoveryCode) {
+			t.Errorf("%q: expected errInvalidRecoveryCode, got %v", test.input, err)
+		}
+	}
+}
+
+// TestRecoverySlot tests that a recovery code opens a file without the password and keyfile
+func TestRecoverySlot(t *testing.T) {
+	code, err := GenerateRecoveryCode()
+	if err != nil {
+		t.Fatalf("Failed to generate recovery code: %v", err)
+	}
+	keyfile := bytes.Repeat([]byte{0x42}, 32)
+	opts := testOptions(2)
+	opts.Keyfile = keyfile
+	opts.RecoveryCode = code
+	plaintext := []byte("opened with a recovery code")
+	path := filepath.Join(t.TempDir(), "slots.enc")
+	if err := os.WriteFile(path, encryptTestData(t, "testpassword", plaintext, opts), 0640); err != nil {
+		t.Fatalf("Failed to write encrypted file: %v", err)
+	}
+
+	slots, err := ReadKeySlots(path)
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("Expected 2 key slots, got %d: %v", len(slots), err)
+	}
+	if slots[0].Recovery || !slots[1].Recovery || slots[1].Keyfile || slots[1].KDF != recoveryKDF {
+		t.Errorf("Unexpected key slots: %+v", slots)
+	}
+
+	for _, secret := range []struct {
+		password string
+		keyfile  []byte
+	}{{"testpassword", keyfile}, {code, nil}, {strings.ToLower(code), keyfile}} {
+		decrypted, err := decryptTestData(readTestFile(t, path), secret.password, DecryptOptions{Keyfile: secret.keyfile})
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Decryption with %q failed: %v", secret.password, err)
+		}
+	}
+	other, _ := GenerateRecoveryCode()
+	if _, err := decryptTestData(readTestFile(t, path), other, DecryptOptions{}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected another recovery code to be refused with ErrWrongPassword, got %v", err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), "testpassword", DecryptOptions{}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected the password without its keyfile to be refused, got %v", err)
+	}
+
+	// The recovery code can set a new password after the old one was lost, and keeps working
+	if err := AddKeySlot(path, code, DecryptOptions{}, PasswordSlot{Password: "newpassword", KDF: opts.KDF}); err != nil {
+		t.Fatalf("Failed to add key slot with the recovery code: %v", err)
+	}
+	if err := RemoveKeySlot(path, "newpassword", DecryptOptions{}, 0); err != nil {
+		t.Fatalf("Failed to remove key slot: %v", err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), code, DecryptOptions{}); err != nil {
+		t.Errorf("Expected the recovery code to keep working: %v", err)
+	}
+}
+
+// TestRecoveryCodeErrors tests that invalid recovery codes and unsupported combinations are refused
+func TestRecoveryCodeErrors(t *testing.T) {
+	opts := testOptions(1)
+	opts.RecoveryCode = "AAGRU-JZUIF-HFW2D-VQKHZ-ZKNWY-PIN32-XXOQX-CCZ6L"
+	if _, err := newFileHeader(opts, "testpassword"); !errors.Is(err, errInvalidRecoveryCode) {
+		t.Errorf("Expected errInvalidRecoveryCode, got %v", err)
+	}
+
+	opts.RecoveryCode, _ = GenerateRecoveryCode()
+	opts.Format = FormatAge
+	if err := encryptTo(&bytes.Buffer{}, bytes.NewReader(nil), "testpassword", opts); err == nil {
+		t.Errorf("Expected a recovery code to be refused for age files")
+	}
+
+	// A recovery code can be added next to recipients
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	opts.Format = FormatHeader
+	opts.Recipients = []*X25519Recipient{identity.Recipient()}
+	written, err := newFileHeader(opts, "")
+	if err != nil {
+		t.Fatalf("Failed to create header: %v", err)
+	}
+	header, err := readHeader(bytes.NewReader(written.raw))
+	if err != nil || len(header.stanzas) != 2 {
+		t.Fatalf("Expected a recipient and a recovery stanza: %v", err)
+	}
+	for _, s := range []secrets{{identities: []*X25519Identity{identity}}, {password: opts.RecoveryCode}} {
+		if fileKey, _, err := header.unwrapFileKey(s); err != nil || !bytes.Equal(fileKey, written.fileKey) {
+			t.Errorf("Failed to unwrap the file key: %v", err)
+		}
+	}
+}
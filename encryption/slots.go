@@ -0,0 +1,348 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// passwordWrapInfo is the HKDF info string of the key that wraps the file key in a key slot.
+const passwordWrapInfo = "GoCrypt password file key"
+
+// passwordStanzaPrefix is the length of a password stanza body in front of the sealed file key:
+// flags, Argon2id time (uint32), memory (uint32) and threads, and the salt.
+const passwordStanzaPrefix = 1 + 4 + 4 + 1 + 16
+
+// Key slot flags, stored in every password stanza.
+const (
+	// slotKeyfile marks key slots whose key mixes in a keyfile next to the password.
+	slotKeyfile = 0x01
+
+	// slotRecovery marks key slots that open with a recovery code, see GenerateRecoveryCode.
+	slotRecovery = 0x02
+
+	// knownSlotFlags holds every key slot flag this version understands.
+	knownSlotFlags = slotKeyfile | slotRecovery
+)
+
+// ErrNoKeySlots is returned when the key slots of a file without them are changed, such as a file
+// written before key slots were introduced or an age file. Such files must be encrypted again.
+var ErrNoKeySlots = errors.New("file has no key slots, encrypt it again to use them")
+
+// KeySlot describes one of the ways to unlock a file, as returned by ReadKeySlots.
+type KeySlot struct {
+	Recipient bool      // Opened by the identity of an X25519 recipient instead of a password
+	Keyfile   bool      // A password slot that needs a keyfile, the password may be empty
+	Recovery  bool      // A slot that opens with a recovery code instead of a password
+	KDF       KDFParams // Argon2id parameters of a password slot
+}
+
+// PasswordSlot holds the secrets of a new key slot: a password, a keyfile or both.
+type PasswordSlot struct {
+	Password string
+	Keyfile  []byte    // Key material from ReadKeyfile, nil for none
+	KDF      KDFParams // Argon2id parameters of the slot
+}
+
+// passwordStanza is the decoded body of a password stanza.
+type passwordStanza struct {
+	flags  byte
+	kdf    KDFParams
+	salt   []byte
+	sealed []byte // File key sealed with ChaCha20-Poly1305
+}
+
+// wrapPassword seals the file key in a new password stanza. The key that seals it is derived from
+// the password with Argon2id and a fresh salt, mixed with the keyfile if there is one, and expanded
+// with HKDF. ad binds the stanza to the file, and flags are stored next to the flags the slot needs.
+func wrapPassword(fileKey, ad []byte, slot PasswordSlot, flags byte) (keyStanza, error) {
+	if err := slot.KDF.Validate(); err != nil {
+		return keyStanza{}, err
+	}
+	salt, err := GenerateSalt()
+	if err != nil {
+		return keyStanza{}, err
+	}
+
+	stanza := passwordStanza{flags: flags, kdf: slot.KDF, salt: salt}
+	if slot.Keyfile != nil {
+		stanza.flags |= slotKeyfile
+	}
+	aead, err := stanza.aead(secrets{password: slot.Password, keyfile: slot.Keyfile})
+	if err != nil {
+		return keyStanza{}, err
+	}
+
+	body := make([]byte, 0, stanzaSizes[stanzaPassword])
+	body = append(body, stanza.flags)
+	body = binary.BigEndian.AppendUint32(body, stanza.kdf.Time)
+	body = binary.BigEndian.AppendUint32(body, stanza.kdf.Memory)
+	body = append(body, stanza.kdf.Threads)
+	body = append(body, salt...)
+	body = aead.Seal(body, make([]byte, aead.NonceSize()), fileKey, ad)
+	return keyStanza{kind: stanzaPassword, body: body}, nil
+}
+
+// parsePasswordStanza decodes the body of a password stanza and checks its flags and KDF parameters.
+func parsePasswordStanza(body []byte) (passwordStanza, error) {
+	stanza := passwordStanza{
+		flags: body[0],
+		kdf: KDFParams{
+			Time:    binary.BigEndian.Uint32(body[1:]),
+			Memory:  binary.BigEndian.Uint32(body[5:]),
+			Threads: body[9],
+		},
+		salt:   body[10:passwordStanzaPrefix],
+		sealed: body[passwordStanzaPrefix:],
+	}
+	if stanza.flags&^knownSlotFlags != 0 {
+		return stanza, fmt.Errorf("%w: unknown key slot flags %#x", ErrUnsupportedVersion, stanza.flags)
+	}
+	params := stanza.kdf
+	if params.Time == 0 || params.Time > maxKDFTime || params.Memory == 0 || params.Memory > maxKDFMemory || params.Threads == 0 {
+		return stanza, fmt.Errorf("%w: invalid Argon2id parameters: time %d, memory %d KiB, threads %d", ErrCorrupted, params.Time, params.Memory, params.Threads)
+	}
+	return stanza, nil
+}
+
+// unwrap recovers the file key from the stanza, or returns errStanzaMismatch if the password or
+// keyfile is wrong.
+func (p passwordStanza) unwrap(s secrets, ad []byte) ([]byte, error) {
+	aead, err := p.aead(s)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), p.sealed, ad)
+	if err != nil {
+		return nil, errStanzaMismatch
+	}
+	return fileKey, nil
+}
+
+// aead derives the key that wraps the file key from the password, and the keyfile if the slot needs one.
+func (p passwordStanza) aead(s secrets) (cipher.AEAD, error) {
+	key := deriveKeyArgon2id(s.password, p.salt, p.kdf)
+	if p.flags&slotKeyfile != 0 {
+		key = mixKeyfile(key, s.keyfile)
+	}
+	wrapKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, []byte(passwordWrapInfo)), wrapKey); err != nil {
+		return nil, fmt.Errorf("failed to derive wrap key: %v", err)
+	}
+	return chacha20poly1305.New(wrapKey)
+}
+
+// ReadKeySlots returns the key slots of the file at path, in the order they are stored and numbered from 0.
+func ReadKeySlots(path string) ([]KeySlot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, _, err := readKeySlotHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]KeySlot, len(header.stanzas))
+	for i, stanza := range header.stanzas {
+		if stanza.kind == stanzaX25519 {
+			slots[i].Recipient = true
+			continue
+		}
+		slot, _ := parsePasswordStanza(stanza.body) // Checked by readStanzas
+		slots[i].Keyfile = slot.flags&slotKeyfile != 0
+		slots[i].Recovery = slot.flags&slotRecovery != 0
+		slots[i].KDF = slot.kdf
+	}
+	return slots, nil
+}
+
+// AddKeySlot adds a key slot for the password and keyfile in slot to the file at path. The file is
+// unlocked with password and the keyfile or identities in opts first. Only the header is rewritten,
+// the payload is copied as it is.
+func AddKeySlot(path, password string, opts DecryptOptions, slot PasswordSlot) error {
+	if slot.Password == "" && slot.Keyfile == nil {
+		return fmt.Errorf("a key slot needs a password or a keyfile")
+	}
+	return rewriteKeySlots(path, func(header *fileHeader) error {
+		if len(header.stanzas) >= maxStanzas {
+			return fmt.Errorf("the file already has the maximum of %d key slots", maxStanzas)
+		}
+		fileKey, _, err := header.unwrapFileKey(opts.secrets(password))
+		if err != nil {
+			return err
+		}
+		stanza, err := wrapPassword(fileKey, header.associatedData(), slot, 0)
+		if err != nil {
+			return err
+		}
+		header.stanzas = append(header.stanzas, stanza)
+		return nil
+	})
+}
+
+// RemoveKeySlot removes the key slot with the given index from the file at path. The password and
+// the keyfile or identities in opts must open one of the remaining slots, so the file cannot be
+// locked by mistake. Only the header is rewritten, the payload is copied as it is.
+func RemoveKeySlot(path, password string, opts DecryptOptions, index int) error {
+	return rewriteKeySlots(path, func(header *fileHeader) error {
+		if index < 0 || index >= len(header.stanzas) {
+			return fmt.Errorf("there is no key slot %d", index)
+		}
+		if len(header.stanzas) == 1 {
+			return fmt.Errorf("cannot remove the only key slot")
+		}
+		header.stanzas = slices.Delete(header.stanzas, index, index+1)
+		header.raw = header.marshal()
+		_, _, err := header.unwrapFileKey(opts.secrets(password))
+		return err
+	})
+}
+
+// Rekey replaces the key slot that password and the keyfile in opts open with a new slot, so the old
+// password stops working while the encrypted contents stay the same. Any other slot the old password
+// opens is removed too. Only the header is rewritten, atomically.
+//
+// The file key does not change, so someone who kept it while they knew the old password can still
+// decrypt the file, and so can copies of the file made before. Encrypt the file again to rule that out.
+// Rekeying with a recovery code turns its slot into a password slot, use AddKeySlot to keep the code.
+func Rekey(path, password string, opts DecryptOptions, slot PasswordSlot) error {
+	if len(opts.Identities) > 0 {
+		return fmt.Errorf("rekey changes a password slot, it cannot be unlocked with an identity")
+	}
+	if slot.Password == "" && slot.Keyfile == nil {
+		return fmt.Errorf("a key slot needs a password or a keyfile")
+	}
+	s := opts.secrets(password)
+	return rewriteKeySlots(path, func(header *fileHeader) error {
+		fileKey, index, err := header.unwrapFileKey(s)
+		if err != nil {
+			return err
+		}
+		if header.stanzas[index].kind != stanzaPassword {
+			return fmt.Errorf("key slot %d is not a password slot", index)
+		}
+		header.stanzas[index], err = wrapPassword(fileKey, header.associatedData(), slot, 0)
+		if err != nil {
+			return err
+		}
+		header.raw = header.marshal()
+
+		// Remove every other slot the old password opens, until it opens none
+		for {
+			_, other, err := header.unwrapFileKey(s)
+			if errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrKeyfileRequired) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if other == index {
+				return fmt.Errorf("the new password must differ from the old one")
+			}
+			header.stanzas = slices.Delete(header.stanzas, other, other+1)
+			header.raw = header.marshal()
+			if other < index {
+				index--
+			}
+		}
+	})
+}
+
+// readKeySlotHeader reads the header of a file with key slots, and returns a reader for the payload after it.
+func readKeySlotHeader(source io.Reader) (*fileHeader, io.Reader, error) {
+	format, reader, err := detectFormat(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch format {
+	case FormatHeader:
+	case FormatUnknown:
+		return nil, nil, ErrNotGoCrypt
+	default:
+		return nil, nil, ErrNoKeySlots
+	}
+
+	header, err := readHeader(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.version < keyWrapVersion {
+		return nil, nil, ErrNoKeySlots
+	}
+	return header, reader, nil
+}
+
+// rewriteKeySlots lets change update the stanzas of the file at path, then writes the new header
+// followed by the unchanged payload to a temporary file that replaces the original. The stanzas are
+// not part of the associated data, so the payload stays valid. The original is left untouched if
+// anything fails.
+func rewriteKeySlots(path string, change func(header *fileHeader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, payload, err := readKeySlotHeader(file)
+	if err != nil {
+		return err
+	}
+	if err := change(header); err != nil {
+		return err
+	}
+	header.raw = header.marshal()
+
+	// The temporary file lives next to the original, so the rename cannot cross file systems
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name()) // Fails harmlessly once the file was renamed
+
+	if _, err := temp.Write(header.raw); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	if _, err := io.Copy(temp, payload); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to copy encrypted data: %w", err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := os.Chmod(temp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// Windows cannot replace a file that is still open
+	file.Close()
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	// Make the rename itself durable, where directories can be synced
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
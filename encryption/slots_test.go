@@ -0,0 +1,219 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// payloadOf returns the data after the header of the file at path
+func payloadOf(t *testing.T, path string) []byte {
+	data := readTestFile(t, path)
+	header, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	return data[len(header.raw):]
+}
+
+// TestKeySlots tests adding and removing key slots, and that only the header changes
+func TestKeySlots(t *testing.T) {
+	kdf := testOptions(1).KDF
+	keyfile := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+	path := filepath.Join(t.TempDir(), "slots.enc")
+	if err := os.WriteFile(path, encryptTestData(t, "firstpassword", plaintext, testOptions(2)), 0640); err != nil {
+		t.Fatalf("Failed to write encrypted file: %v", err)
+	}
+	payload := payloadOf(t, path)
+
+	if err := AddKeySlot(path, "otherpassword", DecryptOptions{}, PasswordSlot{Password: "secondpassword", KDF: kdf}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+	if err := AddKeySlot(path, "firstpassword", DecryptOptions{}, PasswordSlot{KDF: kdf}); err == nil {
+		t.Errorf("Expected a key slot without a password or keyfile to be refused")
+	}
+	if err := AddKeySlot(path, "firstpassword", DecryptOptions{}, PasswordSlot{Password: "secondpassword", KDF: kdf}); err != nil {
+		t.Fatalf("Failed to add key slot: %v", err)
+	}
+	if err := AddKeySlot(path, "secondpassword", DecryptOptions{}, PasswordSlot{Keyfile: keyfile, KDF: kdf}); err != nil {
+		t.Fatalf("Failed to add keyfile slot: %v", err)
+	}
+
+	slots, err := ReadKeySlots(path)
+	if err != nil || len(slots) != 3 {
+		t.Fatalf("Expected 3 key slots, got %d: %v", len(slots), err)
+	}
+	if slots[0].Keyfile || !slots[2].Keyfile || slots[1].Recipient || slots[1].KDF != kdf {
+		t.Errorf("Unexpected key slots: %+v", slots)
+	}
+	if !bytes.Equal(payloadOf(t, path), payload) {
+		t.Errorf("Expected the payload to stay the same")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected the file mode to be kept, got %v: %v", info.Mode(), err)
+	}
+
+	unlock := []struct {
+		password string
+		keyfile  []byte
+	}{{"firstpassword", nil}, {"secondpassword", nil}, {"", keyfile}}
+	for _, secret := range unlock {
+		decrypted, err := decryptTestData(readTestFile(t, path), secret.password, DecryptOptions{Keyfile: secret.keyfile})
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Decryption with %q failed: %v", secret.password, err)
+		}
+	}
+
+	// A slot can only be removed with the secret of another one
+	if err := RemoveKeySlot(path, "firstpassword", DecryptOptions{}, 0); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected removing the slot of the password itself to fail, got %v", err)
+	}
+	if err := RemoveKeySlot(path, "secondpassword", DecryptOptions{}, 3); err == nil {
+		t.Errorf("Expected a missing slot to be refused")
+	}
+	if err := RemoveKeySlot(path, "secondpassword", DecryptOptions{}, 0); err != nil {
+		t.Fatalf("Failed to remove key slot: %v", err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), "firstpassword", DecryptOptions{}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected the removed password to stop working, got %v", err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), "secondpassword", DecryptOptions{}); err != nil {
+		t.Errorf("Expected the remaining password to work: %v", err)
+	}
+	if err := RemoveKeySlot(path, "", DecryptOptions{Keyfile: keyfile}, 0); err != nil {
+		t.Fatalf("Failed to remove key slot: %v", err)
+	}
+	if err := RemoveKeySlot(path, "", DecryptOptions{Keyfile: keyfile}, 0); err == nil {
+		t.Errorf("Expected the only key slot to be kept")
+	}
+	if !bytes.Equal(payloadOf(t, path), payload) {
+		t.Errorf("Expected the payload to stay the same")
+	}
+}
+
+// TestKeySlotsWithRecipients tests that a file encrypted to a recipient can get a password slot
+func TestKeySlotsWithRecipients(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	opts := testOptions(1)
+	opts.Recipients = []*X25519Recipient{identity.Recipient()}
+	plaintext := []byte("shared with a password too")
+	path := filepath.Join(t.TempDir(), "slots.enc")
+	if err := os.WriteFile(path, encryptTestData(t, "", plaintext, opts), 0640); err != nil {
+		t.Fatalf("Failed to write encrypted file: %v", err)
+	}
+
+	if err := AddKeySlot(path, "", DecryptOptions{Identities: []*X25519Identity{identity}}, PasswordSlot{Password: "testpassword", KDF: opts.KDF}); err != nil {
+		t.Fatalf("Failed to add key slot: %v", err)
+	}
+	slots, err := ReadKeySlots(path)
+	if err != nil || len(slots) != 2 || !slots[0].Recipient || slots[1].Recipient {
+		t.Fatalf("Unexpected key slots: %+v: %v", slots, err)
+	}
+	if decrypted, err := decryptTestData(readTestFile(t, path), "testpassword", DecryptOptions{}); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decryption with the password failed: %v", err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), "", DecryptOptions{Identities: []*X25519Identity{identity}}); err != nil {
+		t.Errorf("Decryption with the identity failed: %v", err)
+	}
+}
+
+// TestKeySlotErrors tests that damaged key slots and files without them are refused
+func TestKeySlotErrors(t *testing.T) {
+	header, err := newFileHeader(testOptions(1), "testpassword")
+	if err != nil {
+		t.Fatalf("Failed to create header: %v", err)
+	}
+	slotOffset := len(header.associatedData()) + 1 + 3 // Stanza count, type and length
+
+	unknownFlags := bytes.Clone(header.raw)
+	unknownFlags[slotOffset] = 0x80
+	zeroTime := bytes.Clone(header.raw)
+	copy(zeroTime[slotOffset+1:], []byte{0, 0, 0, 0})
+	if _, err := readHeader(bytes.NewReader(unknownFlags)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected unknown key slot flags to be refused, got %v", err)
+	}
+	if _, err := readHeader(bytes.NewReader(zeroTime)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected invalid KDF parameters to be refused, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "v3.enc")
+	if err := os.WriteFile(path, version3Header(t, testOptions(1)).raw, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := ReadKeySlots(path); !errors.Is(err, ErrNoKeySlots) {
+		t.Errorf("Expected ErrNoKeySlots, got %v", err)
+	}
+	if err := AddKeySlot(path, "testpassword", DecryptOptions{}, PasswordSlot{Password: "otherpassword", KDF: testOptions(1).KDF}); !errors.Is(err, ErrNoKeySlots) {
+		t.Errorf("Expected ErrNoKeySlots, got %v", err)
+	}
+}
+
+// TestRekey tests that rekeying replaces the slot of the old password and keeps the payload
+func TestRekey(t *testing.T) {
+	kdf := testOptions(1).KDF
+	keyfile := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := make([]byte, 2*chunkSize+100)
+	rand.Read(plaintext)
+	path := filepath.Join(t.TempDir(), "slots.enc")
+	if err := os.WriteFile(path, encryptTestData(t, "oldpassword", plaintext, testOptions(2)), 0640); err != nil {
+		t.Fatalf("Failed to write encrypted file: %v", err)
+	}
+	payload := payloadOf(t, path)
+
+	// A second slot with the same password must not keep it working
+	if err := AddKeySlot(path, "oldpassword", DecryptOptions{}, PasswordSlot{Password: "otherpassword", KDF: kdf}); err != nil {
+		t.Fatalf("Failed to add key slot: %v", err)
+	}
+	if err := AddKeySlot(path, "oldpassword", DecryptOptions{}, PasswordSlot{Password: "oldpassword", KDF: kdf}); err != nil {
+		t.Fatalf("Failed to add key slot: %v", err)
+	}
+
+	if err := Rekey(path, "wrongpassword", DecryptOptions{}, PasswordSlot{Password: "newpassword", KDF: kdf}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+	if err := Rekey(path, "oldpassword", DecryptOptions{}, PasswordSlot{Password: "oldpassword", KDF: kdf}); err == nil {
+		t.Errorf("Expected the same password to be refused")
+	}
+	if err := Rekey(path, "oldpassword", DecryptOptions{}, PasswordSlot{Password: "newpassword", KDF: kdf}); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+
+	slots, err := ReadKeySlots(path)
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("Expected 2 key slots, got %d: %v", len(slots), err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), "oldpassword", DecryptOptions{}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected the old password to stop working, got %v", err)
+	}
+	for _, password := range []string{"newpassword", "otherpassword"} {
+		if decrypted, err := decryptTestData(readTestFile(t, path), password, DecryptOptions{}); err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Decryption with %q failed: %v", password, err)
+		}
+	}
+	if !bytes.Equal(payloadOf(t, path), payload) {
+		t.Errorf("Expected the payload to stay the same")
+	}
+
+	// A password can be swapped for a keyfile
+	if err := Rekey(path, "newpassword", DecryptOptions{}, PasswordSlot{Keyfile: keyfile, KDF: kdf}); err != nil {
+		t.Fatalf("Rekey to a keyfile failed: %v", err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), "", DecryptOptions{Keyfile: keyfile}); err != nil {
+		t.Errorf("Decryption with the keyfile failed: %v", err)
+	}
+	if _, err := decryptTestData(readTestFile(t, path), "newpassword", DecryptOptions{}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected the replaced password to stop working, got %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files to be left, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,511 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"fmt"
+	"io"
+)
+
+const (
+	// formatMarker is the first byte of files that use per-chunk nonces without a header.
+	// Legacy files start with their layer count (1-200) so a zero byte never appears there.
+	formatMarker = 0x00
+
+	// markerVersion is written after the format marker. Newer files use the header instead.
+	markerVersion = 1
+
+	// chunkSize is the default amount of plaintext sealed into each chunk.
+	chunkSize = 32 * 1024
+
+	// legacyChunkSize is the chunk size of files without a header, which have nowhere to record it.
+	legacyChunkSize = 32 * 1024
+
+	// streamSuffixSize is the space at the end of every nonce reserved for
+	// the chunk counter (4 bytes) and the last-chunk flag (1 byte).
+	streamSuffixSize = 5
+)
+
+// newStreamNonce builds the nonce for the first chunk of a stream.
+// The nonce is laid out as prefix || counter (big endian) || last flag,
+// following the STREAM construction, so every chunk under a key gets a
+// unique nonce and chunks cannot be reordered, duplicated or dropped.
+func newStreamNonce(prefix []byte, nonceSize int) ([]byte, error) {
+	if len(prefix) != nonceSize-streamSuffixSize {
+		return nil, fmt.Errorf("invalid nonce prefix length: %d", len(prefix))
+	}
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+	return nonce, nil
+}
+
+// nextStreamNonce advances the chunk counter in the nonce.
+func nextStreamNonce(nonce []byte) error {
+	counter := nonce[len(nonce)-streamSuffixSize : len(nonce)-1]
+	incrementNonce(counter)
+	for _, b := range counter {
+		if b != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("stream is too large: chunk counter overflowed")
+}
+
+// setLastChunk marks the nonce as belonging to the final chunk of the stream.
+func setLastChunk(nonce []byte, last bool) {
+	if last {
+		nonce[len(nonce)-1] = 1
+	} else {
+		nonce[len(nonce)-1] = 0
+	}
+}
+
+// streamWriter encrypts everything written to it and writes the sealed chunks to dest.
+// A full chunk is only sealed once more data arrives, so Close can seal the final chunk with
+// the last-chunk flag set. An empty stream still produces one (empty) final chunk.
+type streamWriter struct {
+	dest   io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	ad     []byte // Associated data authenticated with every chunk
+	buffer []byte // Plaintext waiting to be sealed, at most one chunk
+	sealed []byte // Buffer to hold ciphertext (plaintext + MAC)
+	err    error  // First error encountered, returned by every later call
+	closed bool
+
+	pipeline *chunkPipeline // Seals chunks in parallel, nil to seal them one by one
+}
+
+// newStreamWriter creates a writer that seals chunks of size plaintext bytes.
+func newStreamWriter(dest io.Writer, aead cipher.AEAD, prefix []byte, size int, ad []byte) (*streamWriter, error) {
+	nonce, err := newStreamNonce(prefix, aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{
+		dest:   dest,
+		aead:   aead,
+		nonce:  nonce,
+		ad:     ad,
+		buffer: make([]byte, 0, size),
+		sealed: make([]byte, size+aead.Overhead()),
+	}, nil
+}
+
+// Write buffers the plaintext and seals every chunk that is known not to be the last one.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, fmt.Errorf("write to closed stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(w.buffer) == cap(w.buffer) {
+			if w.err = w.seal(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):cap(w.buffer)], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// setWorkers seals up to workers chunks at the same time, in the background. The output does
+// not change, every chunk still gets the nonce of its position in the stream. Without workers
+// the chunks are sealed one by one by the caller.
+func (w *streamWriter) setWorkers(workers int) {
+	if workers < 1 {
+		return
+	}
+	w.pipeline = newChunkPipeline(workers, cap(w.buffer), len(w.sealed), len(w.nonce), func(task *chunkTask) {
+		task.out = w.aead.Seal(task.out[:0], task.nonce, task.in, w.ad)
+	})
+	w.sealed = nil
+}
+
+// Close seals the final chunk. It does not close dest.
+func (w *streamWriter) Close() error {
+	if w.err != nil || w.closed {
+		return w.err
+	}
+	w.closed = true
+	w.err = w.seal(true)
+	return w.err
+}
+
+// seal encrypts the buffered plaintext as the next chunk and writes it out.
+func (w *streamWriter) seal(last bool) error {
+	if w.pipeline != nil {
+		return w.sealParallel(last)
+	}
+
+	setLastChunk(w.nonce, last)
+	ciphertext := w.aead.Seal(w.sealed[:0], w.nonce, w.buffer, w.ad)
+	if _, err := w.dest.Write(ciphertext); err != nil {
+		return fmt.Errorf("failed to write encrypted data: %v", err)
+	}
+	w.buffer = w.buffer[:0]
+
+	if last {
+		return nil
+	}
+	return nextStreamNonce(w.nonce)
+}
+
+// sealParallel hands the buffered plaintext to the pipeline and writes out the chunks that are done,
+// waiting for the oldest one when every worker is busy. The final chunk waits for all of them.
+func (w *streamWriter) sealParallel(last bool) error {
+	if w.pipeline.full() {
+		if err := w.writeOldest(); err != nil {
+			return err
+		}
+	}
+
+	// Swap buffers with the task, so the plaintext is not copied
+	task := w.pipeline.task()
+	task.in, w.buffer = w.buffer, task.in
+	setLastChunk(w.nonce, last)
+	copy(task.nonce, w.nonce)
+	w.pipeline.start(task)
+
+	if !last {
+		return nextStreamNonce(w.nonce)
+	}
+	for !w.pipeline.empty() {
+		if err := w.writeOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOldest waits for the oldest chunk in the pipeline and writes it out.
+func (w *streamWriter) writeOldest() error {
+	task := w.pipeline.wait()
+	defer w.pipeline.release(task)
+	if _, err := w.dest.Write(task.out); err != nil {
+		return fmt.Errorf("failed to write encrypted data: %v", err)
+	}
+	return nil
+}
+
+// streamReader decrypts the chunks written by streamWriter.
+// It fails with ErrTruncated if the stream ends before the chunk carrying the last-chunk flag.
+type streamReader struct {
+	source    *bufio.Reader
+	aead      cipher.AEAD
+	nonce     []byte
+	ad        []byte // Associated data authenticated with every chunk
+	layer     int    // Layer number used in error messages, 0 if not part of a layered file
+	outer     bool   // The first chunk is the only check of the password, so failing to open it means a wrong password
+	started   bool   // A chunk has been opened
+	chunks    int    // Chunks read from source
+	sealed    []byte // Buffer to hold ciphertext (plaintext + MAC)
+	buffer    []byte // Buffer for decrypted plaintext
+	plaintext []byte // Decrypted plaintext not returned yet
+	err       error  // First error encountered, returned by every later call
+	done      bool   // The last chunk has been read
+
+	pipeline *chunkPipeline // Opens chunks in parallel, nil to open them one by one
+	current  *chunkTask     // Chunk whose plaintext is being returned
+	readDone bool           // No more chunks will be read ahead
+	readErr  error          // Error that stopped reading ahead, returned once the pending chunks are used up
+}
+
+// newStreamReader creates a reader that opens chunks of size plaintext bytes.
+func newStreamReader(source io.Reader, aead cipher.AEAD, prefix []byte, size int, ad []byte) (*streamReader, error) {
+	nonce, err := newStreamNonce(prefix, aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		source: bufio.NewReader(source),
+		aead:   aead,
+		nonce:  nonce,
+		ad:     ad,
+		sealed: make([]byte, size+aead.Overhead()),
+		buffer: make([]byte, size),
+	}, nil
+}
+
+// setWorkers opens up to workers chunks at the same time in the background, reading ahead of the
+// caller. Without workers the chunks are opened one by one by the caller.
+func (r *streamReader) setWorkers(workers int) {
+	if workers < 1 {
+		return
+	}
+	r.pipeline = newChunkPipeline(workers, len(r.sealed), len(r.buffer), len(r.nonce), func(task *chunkTask) {
+		task.out, task.err = r.aead.Open(task.out[:0], task.nonce, task.in, r.ad)
+	})
+	r.sealed, r.buffer = nil, nil
+}
+
+// Read returns decrypted plaintext, opening the next chunk when needed.
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.open()
+	}
+
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (r *streamReader) open() error {
+	if r.pipeline != nil {
+		return r.openParallel()
+	}
+
+	n, last, err := r.readChunk(r.sealed)
+	if err != nil {
+		return err
+	}
+
+	setLastChunk(r.nonce, last)
+	plaintext, err := r.aead.Open(r.buffer[:0], r.nonce, r.sealed[:n], r.ad)
+	if err != nil {
+		r.plaintext, err = r.openError(r.buffer[:0], r.sealed[:n], r.nonce, last)
+		return r.wrap(err)
+	}
+	r.plaintext = plaintext
+	r.started = true
+
+	if last {
+		r.done = true
+		return nil
+	}
+	return nextStreamNonce(r.nonce)
+}
+
+// openParallel reads chunks ahead until every worker is busy and returns the oldest one once it is opened.
+// Errors are returned in stream order, after the plaintext of every chunk before them.
+func (r *streamReader) openParallel() error {
+	if r.current != nil {
+		r.pipeline.release(r.current)
+		r.current = nil
+	}
+
+	for !r.readDone && !r.pipeline.full() {
+		task := r.pipeline.task()
+		n, last, err := r.readChunk(task.in[:cap(task.in)])
+		if err == nil && !last {
+			// Advance before starting, so a counter overflow stops the read ahead
+			copy(task.nonce, r.nonce)
+			err = nextStreamNonce(r.nonce)
+		} else if err == nil {
+			setLastChunk(r.nonce, true)
+			copy(task.nonce, r.nonce)
+		}
+		if err != nil {
+			r.pipeline.release(task)
+			r.readDone, r.readErr = true, err
+			break
+		}
+
+		task.in, task.last = task.in[:n], last
+		r.pipeline.start(task)
+		r.readDone = last
+	}
+
+	if r.pipeline.empty() {
+		return r.readErr
+	}
+	task := r.pipeline.wait()
+	if task.err != nil {
+		var err error
+		r.current = task
+		r.plaintext, err = r.openError(task.out[:0], task.in, task.nonce, task.last)
+		return r.wrap(err)
+	}
+	r.current = task
+	r.plaintext = task.out
+	r.started = true
+	r.done = task.last
+	return nil
+}
+
+// readChunk reads the next sealed chunk into sealed, which must have room for a full chunk,
+// and reports how long it is and whether it is the last one.
+func (r *streamReader) readChunk(sealed []byte) (int, bool, error) {
+	n, err := io.ReadFull(r.source, sealed)
+	if err == io.EOF {
+		return 0, false, r.wrap(ErrTruncated)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, false, err
+	}
+
+	r.chunks++
+
+	// A short read means we hit the end, otherwise peek to see if anything is left. The final
+	// chunk is only empty when it is the only one, writers never seal an empty chunk after data.
+	if err != nil {
+		if n == r.aead.Overhead() && r.chunks > 1 {
+			return 0, false, r.wrap(fmt.Errorf("%w: empty final chunk", ErrCorrupted))
+		}
+		return n, true, nil
+	}
+	if _, err := r.source.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return n, false, nil
+}
+
+// openError works out why the sealed chunk did not open with the nonce. A full chunk that opens with
+// the last-chunk flag flipped is intact: at the end of the data it means the stream was cut on a chunk
+// boundary, followed by more data it means something was appended after the final chunk. The plaintext
+// of an intact chunk is appended to dst and returned with the error, so it is released before the error
+// like that of the chunks before it.
+func (r *streamReader) openError(dst, sealed, nonce []byte, last bool) ([]byte, error) {
+	if len(sealed) == r.sealedSize() {
+		setLastChunk(nonce, !last)
+		plaintext, err := r.aead.Open(dst, nonce, sealed, r.ad)
+		setLastChunk(nonce, last)
+		if err == nil && last {
+			return plaintext, ErrTruncated
+		}
+		if err == nil {
+			return plaintext, fmt.Errorf("%w: data after the final chunk", ErrCorrupted)
+		}
+	}
+	return nil, authError(r.outer, r.started)
+}
+
+// sealedSize returns the size of a full sealed chunk.
+func (r *streamReader) sealedSize() int {
+	if r.pipeline != nil {
+		return r.pipeline.inSize
+	}
+	return len(r.sealed)
+}
+
+// wrap adds the layer number to errors about this stream.
+func (r *streamReader) wrap(err error) error {
+	if r.layer == 0 {
+		return err
+	}
+	return fmt.Errorf("layer %d decryption failed: %w", r.layer, err)
+}
+
+// authError classifies a chunk that failed to authenticate. Only the first chunk read from the
+// file itself points to a wrong key, and only when nothing else checked the key before, every later
+// chunk and every inner layer was opened with a key that already worked, so the data must have been changed.
+func authError(outer, started bool) error {
+	if outer && !started {
+		return ErrWrongPassword
+	}
+	return ErrCorrupted
+}
+
+// sealStream encrypts everything read from source and writes the ciphertext to dest.
+func sealStream(aead cipher.AEAD, prefix []byte, size int, ad []byte, source io.Reader, dest io.Writer) error {
+	writer, err := newStreamWriter(dest, aead, prefix, size, ad)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, source); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// openStream decrypts chunks written by sealStream and writes the plaintext to dest.
+func openStream(aead cipher.AEAD, prefix []byte, size int, ad []byte, source io.Reader, dest io.Writer) error {
+	reader, err := newStreamReader(source, aead, prefix, size, ad)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, reader)
+	return err
+}
+
+// layeredWriter passes everything written to it through one streamWriter per layer.
+// The first layer receives the plaintext and the last layer writes to the destination.
+type layeredWriter struct {
+	layers []*streamWriter
+}
+
+// layerWorkers splits workers chunks in flight between the layers, so stacking more layers does
+// not multiply the memory. Every layer gets at least one, which still runs the layers side by side.
+// Zero keeps all layers on the caller's goroutine.
+func layerWorkers(workers, layers int) int {
+	if workers <= 1 {
+		return 0
+	}
+	return max(1, workers/layers)
+}
+
+// newLayeredWriter stacks the layers described by the header on top of dest.
+// With workers above 1 the layers share up to workers chunks sealed at the same time.
+func newLayeredWriter(dest io.Writer, header *fileHeader, keys [][]byte, workers int) (*layeredWriter, error) {
+	writer := &layeredWriter{layers: make([]*streamWriter, len(header.layers))}
+	workers = layerWorkers(workers, len(header.layers))
+	for layer := len(header.layers) - 1; layer >= 0; layer-- {
+		params := header.layers[layer]
+		aead, err := newAEAD(params.cipher, keys[layer])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AEAD: %v", err)
+		}
+		stage, err := newStreamWriter(dest, aead, params.noncePrefix, int(header.chunkSize), header.associatedData())
+		if err != nil {
+			return nil, err
+		}
+		stage.setWorkers(workers)
+		writer.layers[layer] = stage
+		dest = stage
+	}
+	return writer, nil
+}
+
+// Write encrypts p with every layer.
+func (w *layeredWriter) Write(p []byte) (int, error) {
+	return w.layers[0].Write(p)
+}
+
+// Close flushes the final chunk of every layer, starting with the innermost one.
+func (w *layeredWriter) Close() error {
+	for _, layer := range w.layers {
+		if err := layer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newLayeredReader stacks the layers described by the header on top of source and returns
+// a reader for the plaintext. The outermost layer reads from source. With workers above 1 the layers
+// share up to workers chunks opened at the same time.
+func newLayeredReader(source io.Reader, header *fileHeader, keys [][]byte, workers int) (io.Reader, error) {
+	workers = layerWorkers(workers, len(header.layers))
+	for layer := len(header.layers) - 1; layer >= 0; layer-- {
+		params := header.layers[layer]
+		aead, err := newAEAD(params.cipher, keys[layer])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AEAD: %v", err)
+		}
+		stage, err := newStreamReader(source, aead, params.noncePrefix, int(header.chunkSize), header.associatedData())
+		if err != nil {
+			return nil, err
+		}
+		stage.layer = layer + 1
+		stage.outer = header.checksPassword(layer)
+		stage.setWorkers(workers)
+		source = stage
+	}
+	return source, nil
+}
@@ -0,0 +1,243 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// newTestStreamCipher returns a random nonce prefix and key
+func newTestStreamCipher(t *testing.T) (prefix []byte, key []byte) {
+	key = make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	prefix = make([]byte, chacha20poly1305.NonceSizeX-streamSuffixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		t.Fatalf("Failed to generate nonce prefix: %v", err)
+	}
+	return prefix, key
+}
+
+// sealTestStream seals the plaintext and returns the ciphertext
+func sealTestStream(t *testing.T, key, prefix, plaintext []byte) []byte {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		t.Fatalf("Failed to create AEAD: %v", err)
+	}
+	var ciphertext bytes.Buffer
+	if err := sealStream(aead, prefix, chunkSize, nil, bytes.NewReader(plaintext), &ciphertext); err != nil {
+		t.Fatalf("Failed to seal stream: %v", err)
+	}
+	return ciphertext.Bytes()
+}
+
+// openTestStream opens the ciphertext and returns the plaintext
+func openTestStream(key, prefix, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext bytes.Buffer
+	err = openStream(aead, prefix, chunkSize, nil, bytes.NewReader(ciphertext), &plaintext)
+	return plaintext.Bytes(), err
+}
+
+// TestStreamRoundTrip tests sealing and opening streams around the chunk boundaries
+func TestStreamRoundTrip(t *testing.T) {
+	prefix, key := newTestStreamCipher(t)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := sealTestStream(t, key, prefix, plaintext)
+		decrypted, err := openTestStream(key, prefix, ciphertext)
+		if err != nil {
+			t.Fatalf("Failed to open stream of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, decrypted) {
+			t.Errorf("Plaintext mismatch for stream of %d bytes", size)
+		}
+	}
+}
+
+// TestStreamUniqueNonces tests that identical chunks produce different ciphertext
+func TestStreamUniqueNonces(t *testing.T) {
+	prefix, key := newTestStreamCipher(t)
+	plaintext := make([]byte, 3*chunkSize) // Three identical all-zero chunks
+
+	ciphertext := sealTestStream(t, key, prefix, plaintext)
+	sealedChunk := chunkSize + chacha20poly1305.Overhead
+	first := ciphertext[:sealedChunk]
+	second := ciphertext[sealedChunk : 2*sealedChunk]
+	if bytes.Equal(first, second) {
+		t.Fatalf("Expected identical chunks to be sealed with different nonces")
+	}
+}
+
+// TestStreamTampering tests that reordered, duplicated and dropped chunks are rejected
+func TestStreamTampering(t *testing.T) {
+	prefix, key := newTestStreamCipher(t)
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+
+	ciphertext := sealTestStream(t, key, prefix, plaintext)
+	sealedChunk := chunkSize + chacha20poly1305.Overhead
+	chunk := func(i int) []byte {
+		end := (i + 1) * sealedChunk
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		return ciphertext[i*sealedChunk : end]
+	}
+	join := func(chunks ...[]byte) []byte {
+		return bytes.Join(chunks, nil)
+	}
+
+	tests := map[string][]byte{
+		"reordered":       join(chunk(1), chunk(0), chunk(2), chunk(3)),
+		"duplicated":      join(chunk(0), chunk(0), chunk(1), chunk(2), chunk(3)),
+		"dropped middle":  join(chunk(0), chunk(2), chunk(3)),
+		"dropped last":    join(chunk(0), chunk(1), chunk(2)),
+		"truncated chunk": ciphertext[:len(ciphertext)-1],
+		"empty":           {},
+	}
+	for name, tampered := range tests {
+		if _, err := openTestStream(key, prefix, tampered); err == nil {
+			t.Errorf("Expected %s stream to fail decryption", name)
+		}
+	}
+}
+
+// TestStreamFinalChunk tests that the plaintext of every intact chunk is released before an error
+// about the end of the stream, and that a final chunk is only empty when it is the only one
+func TestStreamFinalChunk(t *testing.T) {
+	prefix, key := newTestStreamCipher(t)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		t.Fatalf("Failed to create AEAD: %v", err)
+	}
+	plaintext := make([]byte, 2*chunkSize)
+	rand.Read(plaintext)
+	ciphertext := sealTestStream(t, key, prefix, plaintext)
+	sealedChunk := chunkSize + chacha20poly1305.Overhead
+
+	// The writer never does this, an empty final chunk after a full one
+	nonce, err := newStreamNonce(prefix, aead.NonceSize())
+	if err != nil {
+		t.Fatalf("Failed to create nonce: %v", err)
+	}
+	emptyFinal := aead.Seal(nil, nonce, plaintext[:chunkSize], nil)
+	nextStreamNonce(nonce)
+	setLastChunk(nonce, true)
+	emptyFinal = aead.Seal(emptyFinal, nonce, nil, nil)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		released int // Plaintext bytes returned before the error
+		want     error
+	}{
+		{"cut on a chunk boundary", ciphertext[:sealedChunk], chunkSize, ErrTruncated},
+		{"data after the final chunk", append(bytes.Clone(ciphertext), 1), 2 * chunkSize, ErrCorrupted},
+		{"empty final chunk", emptyFinal, chunkSize, ErrCorrupted},
+	}
+	for _, test := range tests {
+		for _, workers := range []int{0, 2} {
+			reader, err := newStreamReader(bytes.NewReader(test.data), aead, prefix, chunkSize, nil)
+			if err != nil {
+				t.Fatalf("Failed to create reader: %v", err)
+			}
+			reader.setWorkers(workers)
+			decrypted, err := io.ReadAll(reader)
+			if !errors.Is(err, test.want) {
+				t.Errorf("%s, %d workers: expected %v, got %v", test.name, workers, test.want, err)
+			}
+			if !bytes.Equal(decrypted, plaintext[:test.released]) {
+				t.Errorf("%s, %d workers: expected %d bytes of plaintext, got %d", test.name, workers, test.released, len(decrypted))
+			}
+		}
+	}
+
+	if _, err := newChunkReaderAt(bytes.NewReader(emptyFinal), int64(len(emptyFinal)), aead, prefix, chunkSize, nil, 1, true); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected random access to refuse an empty final chunk, got %v", err)
+	}
+}
+
+// TestNextStreamNonceOverflow tests that the chunk counter refuses to wrap around
+func TestNextStreamNonceOverflow(t *testing.T) {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce[len(nonce)-streamSuffixSize:], []byte{0xff, 0xff, 0xff, 0xfe})
+
+	if err := nextStreamNonce(nonce); err != nil {
+		t.Fatalf("Unexpected error before overflow: %v", err)
+	}
+	if err := nextStreamNonce(nonce); err == nil {
+		t.Fatalf("Expected an error when the chunk counter overflows")
+	}
+}
+
+// TestStreamWriterWriteSizes tests that the ciphertext does not depend on how the plaintext is split across writes
+func TestStreamWriterWriteSizes(t *testing.T) {
+	prefix, key := newTestStreamCipher(t)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		t.Fatalf("Failed to create AEAD: %v", err)
+	}
+	plaintext := make([]byte, 2*chunkSize+123)
+	rand.Read(plaintext)
+	expected := sealTestStream(t, key, prefix, plaintext)
+
+	for _, writeSize := range []int{1, 1000, chunkSize, chunkSize + 1, len(plaintext)} {
+		var ciphertext bytes.Buffer
+		writer, err := newStreamWriter(&ciphertext, aead, prefix, chunkSize, nil)
+		if err != nil {
+			t.Fatalf("Failed to create stream writer: %v", err)
+		}
+		for offset := 0; offset < len(plaintext); offset += writeSize {
+			end := min(offset+writeSize, len(plaintext))
+			if _, err := writer.Write(plaintext[offset:end]); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if !bytes.Equal(expected, ciphertext.Bytes()) {
+			t.Errorf("Ciphertext differs when writing %d bytes at a time", writeSize)
+		}
+	}
+}
+
+// TestLayeredPipelineRoundTrip tests stacking several layers in memory, at and around the chunk boundary
+func TestLayeredPipelineRoundTrip(t *testing.T) {
+	key := "testpassword"
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 5*chunkSize + 7} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		ciphertext := encryptTestData(t, key, plaintext, testOptions(4))
+
+		// Every layer adds one tag per chunk, so the output must be larger than a single layer would be
+		header, err := readHeader(bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatalf("%d bytes: failed to read header: %v", size, err)
+		}
+		chunks := len(plaintext)/chunkSize + 1
+		if len(ciphertext) <= len(header.raw)+len(plaintext)+chunks*chacha20poly1305.Overhead {
+			t.Fatalf("%d bytes: expected every layer to be applied, got %d bytes", size, len(ciphertext))
+		}
+
+		decrypted, err := decryptTestData(ciphertext, key, DecryptOptions{})
+		if err != nil {
+			t.Fatalf("%d bytes: failed to decrypt layers: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, decrypted) {
+			t.Errorf("%d bytes: plaintext mismatch after the layered round trip", size)
+		}
+	}
+}
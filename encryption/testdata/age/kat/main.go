@@ -0,0 +1,58 @@
+// Command kat writes the known answer age files kat_x25519.age and kat_scrypt.age to the directory
+// given as its argument, with the age library and randomness that is the same on every run.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+
+	"filippo.io/age"
+)
+
+// countingRand returns the bytes 0, 1, 2, ... wrapping at 256
+type countingRand struct{ next byte }
+
+func (r *countingRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.next
+		r.next++
+	}
+	return len(p), nil
+}
+
+// wrapOnly hides the WrapWithLabels method of the scrypt recipient, which draws 16 random bytes for
+// a label that is only used in memory and never written to the file
+type wrapOnly struct{ recipient age.Recipient }
+
+func (w wrapOnly) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return w.recipient.Wrap(fileKey)
+}
+
+func write(path string, recipient age.Recipient) {
+	rand.Reader = &countingRand{}
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipient)
+	if err != nil {
+		panic(err)
+	}
+	w.Write([]byte("Known answer test written by the age v1.2.1 library.\n"))
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	os.WriteFile(path, out.Bytes(), 0644)
+}
+
+func main() {
+	x, err := age.ParseX25519Recipient("age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj")
+	if err != nil {
+		panic(err)
+	}
+	write(os.Args[1]+"/kat_x25519.age", x)
+	s, err := age.NewScryptRecipient("password")
+	if err != nil {
+		panic(err)
+	}
+	s.SetWorkFactor(10)
+	write(os.Args[1]+"/kat_scrypt.age", wrapOnly{s})
+}
@@ -0,0 +1,202 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// X25519 keys are written as bech32 strings in the same encoding as age, so a key pair works with both tools.
+const (
+	x25519RecipientHRP = "age"
+	x25519IdentityHRP  = "age-secret-key-"
+)
+
+// x25519WrapInfo is the HKDF info string of the key that wraps the file key for a recipient.
+const x25519WrapInfo = "GoCrypt X25519 file key"
+
+// errStanzaMismatch is returned when an identity or password cannot unwrap a stanza, the caller tries the next one.
+var errStanzaMismatch = errors.New("stanza does not open with this key")
+
+// X25519Recipient is a public key that files can be encrypted to.
+type X25519Recipient struct {
+	publicKey []byte
+}
+
+// X25519Identity is a private key that decrypts the files encrypted to its recipient.
+type X25519Identity struct {
+	secretKey []byte
+	publicKey []byte
+}
+
+// GenerateX25519Identity creates a new random key pair.
+func GenerateX25519Identity() (*X25519Identity, error) {
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(secretKey); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return newX25519Identity(secretKey)
+}
+
+// newX25519Identity computes the public key that belongs to the secret key.
+func newX25519Identity(secretKey []byte) (*X25519Identity, error) {
+	publicKey, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 key: %v", err)
+	}
+	return &X25519Identity{secretKey: secretKey, publicKey: publicKey}, nil
+}
+
+// ParseX25519Recipient parses a public key in the "age1..." form.
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	hrp, publicKey, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %v", s, err)
+	}
+	if hrp != x25519RecipientHRP || len(publicKey) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid recipient %q: not an X25519 public key", s)
+	}
+	return &X25519Recipient{publicKey: publicKey}, nil
+}
+
+// ParseX25519Identity parses a private key in the "AGE-SECRET-KEY-1..." form.
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	hrp, secretKey, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %v", err)
+	}
+	if hrp != x25519IdentityHRP || len(secretKey) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid identity: not an X25519 private key")
+	}
+	return newX25519Identity(secretKey)
+}
+
+// ReadIdentities reads the private keys from an identity file, with one key per line.
+// Empty lines and lines starting with # are skipped.
+func ReadIdentities(path string) ([]*X25519Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+	defer file.Close()
+
+	var identities []*X25519Identity
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		identity, err := ParseX25519Identity(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities found in %s", path)
+	}
+	return identities, nil
+}
+
+// Recipient returns the public key of the identity.
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{publicKey: i.publicKey}
+}
+
+// String encodes the private key in the "AGE-SECRET-KEY-1..." form.
+func (i *X25519Identity) String() string {
+	encoded, _ := bech32Encode(x25519IdentityHRP, i.secretKey)
+	return strings.ToUpper(encoded)
+}
+
+// String encodes the public key in the "age1..." form.
+func (r *X25519Recipient) String() string {
+	encoded, _ := bech32Encode(x25519RecipientHRP, r.publicKey)
+	return encoded
+}
+
+// wrap encrypts the file key to the recipient. A fresh ephemeral key is agreed with the recipient's
+// public key, and the shared secret keys ChaCha20-Poly1305 that seals the file key. The stanza holds
+// the ephemeral public key followed by the sealed file key. ad binds the stanza to the file.
+func (r *X25519Recipient) wrap(fileKey, ad []byte) (keyStanza, error) {
+	share, shared, err := r.agree()
+	if err != nil {
+		return keyStanza{}, err
+	}
+
+	aead, err := x25519WrapAEAD(shared, share, r.publicKey, x25519WrapInfo)
+	if err != nil {
+		return keyStanza{}, err
+	}
+	body := aead.Seal(share, make([]byte, aead.NonceSize()), fileKey, ad)
+	return keyStanza{kind: stanzaX25519, body: body}, nil
+}
+
+// unwrap recovers the file key from a stanza written by wrap, or returns errStanzaMismatch if the
+// stanza was written for another recipient.
+func (i *X25519Identity) unwrap(stanza keyStanza, ad []byte) ([]byte, error) {
+	share, sealed := stanza.body[:curve25519.PointSize], stanza.body[curve25519.PointSize:]
+	return i.open(share, sealed, ad, x25519WrapInfo)
+}
+
+// agree creates an ephemeral key pair and agrees a shared secret with the recipient's public key.
+// It returns the ephemeral public key, which the recipient needs to agree the same secret.
+func (r *X25519Recipient) agree() ([]byte, []byte, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, r.publicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid recipient %s: %v", r, err)
+	}
+	return share, shared, nil
+}
+
+// open agrees the shared secret with the ephemeral public key in share and opens the file key sealed
+// with it, returning errStanzaMismatch if it was sealed for another recipient.
+func (i *X25519Identity) open(share, sealed, ad []byte, info string) ([]byte, error) {
+	shared, err := curve25519.X25519(i.secretKey, share)
+	if err != nil {
+		return nil, errStanzaMismatch
+	}
+
+	aead, err := x25519WrapAEAD(shared, share, i.publicKey, info)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed, ad)
+	if err != nil {
+		return nil, errStanzaMismatch
+	}
+	return fileKey, nil
+}
+
+// x25519WrapAEAD derives the key that wraps the file key from the shared secret with HKDF-SHA256.
+// Both public keys are used as the salt, so the key belongs to this exchange only.
+func x25519WrapAEAD(shared, share, publicKey []byte, info string) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, share...), publicKey...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(info)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive wrap key: %v", err)
+	}
+	return chacha20poly1305.New(key)
+}
@@ -0,0 +1,175 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBech32 tests the bech32 encoding against BIP 173 vectors and a round trip
+func TestBech32(t *testing.T) {
+	for _, valid := range []string{"A12UEL5L", "abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", "split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w"} {
+		if _, _, err := bech32Decode(valid); err != nil {
+			t.Errorf("%s: expected valid string, got %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"a12uel5m", "A12uEL5L", "1pzry9x0s0muk", "abc1rzg", "x1b4n0q5v"} {
+		if _, _, err := bech32Decode(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+
+	data := make([]byte, 32)
+	rand.Read(data)
+	encoded, err := bech32Encode("test", data)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	hrp, decoded, err := bech32Decode(strings.ToUpper(encoded))
+	if err != nil || hrp != "test" || !bytes.Equal(decoded, data) {
+		t.Errorf("Round trip failed: %q %x %v", hrp, decoded, err)
+	}
+}
+
+// TestX25519Keys tests that keys survive being written out and parsed again
+func TestX25519Keys(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	if !strings.HasPrefix(identity.String(), "AGE-SECRET-KEY-1") || !strings.HasPrefix(identity.Recipient().String(), "age1") {
+		t.Errorf("Unexpected key encoding: %s %s", identity, identity.Recipient())
+	}
+
+	parsed, err := ParseX25519Identity(identity.String())
+	if err != nil {
+		t.Fatalf("Failed to parse identity: %v", err)
+	}
+	if !bytes.Equal(parsed.publicKey, identity.publicKey) {
+		t.Errorf("Parsed identity has another public key")
+	}
+	recipient, err := ParseX25519Recipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("Failed to parse recipient: %v", err)
+	}
+	if !bytes.Equal(recipient.publicKey, identity.publicKey) {
+		t.Errorf("Parsed recipient has another public key")
+	}
+
+	if _, err := ParseX25519Recipient(identity.String()); err == nil {
+		t.Errorf("Expected an identity to be refused as a recipient")
+	}
+	if _, err := ParseX25519Identity(identity.Recipient().String()); err == nil {
+		t.Errorf("Expected a recipient to be refused as an identity")
+	}
+
+	// Identity files hold one key per line next to comments
+	path := filepath.Join(t.TempDir(), "key.txt")
+	other, _ := GenerateX25519Identity()
+	contents := "# public key: " + identity.Recipient().String() + "\n" + identity.String() + "\n\n" + other.String() + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write identity file: %v", err)
+	}
+	identities, err := ReadIdentities(path)
+	if err != nil || len(identities) != 2 {
+		t.Fatalf("Expected 2 identities, got %d: %v", len(identities), err)
+	}
+	if err := os.WriteFile(path, []byte("# nothing here\n"), 0600); err != nil {
+		t.Fatalf("Failed to write identity file: %v", err)
+	}
+	if _, err := ReadIdentities(path); err == nil {
+		t.Errorf("Expected an identity file without keys to be refused")
+	}
+}
+
+// TestEncryptToRecipients tests that every recipient can decrypt the file and nobody else can
+func TestEncryptToRecipients(t *testing.T) {
+	var identities []*X25519Identity
+	for i := 0; i < 3; i++ {
+		identity, err := GenerateX25519Identity()
+		if err != nil {
+			t.Fatalf("Failed to generate identity: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	opts := testOptions(2)
+	opts.Recipients = []*X25519Recipient{identities[0].Recipient(), identities[1].Recipient()}
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+	var ciphertext bytes.Buffer
+	if err := encryptTo(&ciphertext, bytes.NewReader(plaintext), "", opts); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	data := ciphertext.Bytes()
+
+	header, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if header.version != keyWrapVersion || len(header.stanzas) != 2 {
+		t.Fatalf("Expected a version %d header with 2 stanzas, got version %d with %d", keyWrapVersion, header.version, len(header.stanzas))
+	}
+
+	decrypt := func(data []byte, identities ...*X25519Identity) ([]byte, error) {
+		reader, err := NewDecryptReaderWithOptions(bytes.NewReader(data), "", DecryptOptions{Identities: identities})
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(reader)
+	}
+	for i, identity := range identities[:2] {
+		decrypted, err := decrypt(data, identity)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Recipient %d: decryption failed: %v", i+1, err)
+		}
+	}
+	if decrypted, err := decrypt(data, identities[2], identities[1]); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Expected the second identity to match: %v", err)
+	}
+
+	readerAt, err := NewDecryptReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), "", DecryptOptions{Identities: identities[1:2]})
+	if err != nil {
+		t.Fatalf("Failed to open for random access: %v", err)
+	}
+	part := make([]byte, 100)
+	if _, err := readerAt.ReadAt(part, chunkSize); err != nil || !bytes.Equal(part, plaintext[chunkSize:chunkSize+100]) {
+		t.Errorf("Random access read failed: %v", err)
+	}
+
+	// A changed stanza only locks out its recipient, a changed header locks out everyone
+	stanzaChanged := bytes.Clone(data)
+	stanzaChanged[len(header.raw)-10] ^= 0x01
+	headerChanged := bytes.Clone(data)
+	headerChanged[len(header.associatedData())-1] ^= 0x01
+
+	tests := []struct {
+		name       string
+		data       []byte
+		identities []*X25519Identity
+		want       error
+	}{
+		{"no identity", data, nil, ErrIdentityRequired},
+		{"other identity", data, identities[2:], ErrNoMatchingIdentity},
+		{"changed stanza", stanzaChanged, identities[1:2], ErrNoMatchingIdentity},
+		{"changed header", headerChanged, identities[:1], ErrNoMatchingIdentity},
+	}
+	for _, test := range tests {
+		if _, err := decrypt(test.data, test.identities...); !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+	if _, err := decrypt(stanzaChanged, identities[0]); err != nil {
+		t.Errorf("Expected the other recipient to decrypt the file with a changed stanza: %v", err)
+	}
+
+	opts.Keyfile = make([]byte, 32)
+	if _, err := newFileHeader(opts, ""); err == nil {
+		t.Errorf("Expected a keyfile to be refused with recipients")
+	}
+}
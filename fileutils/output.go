@@ -0,0 +1,183 @@
+package fileutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CollisionPolicy decides what happens when an output file already exists.
+type CollisionPolicy string
+
+const (
+	CollisionSkip      CollisionPolicy = "skip"      // Leave the existing file and skip the input
+	CollisionOverwrite CollisionPolicy = "overwrite" // Replace the existing file
+	CollisionRename    CollisionPolicy = "rename"    // Write to a free name such as "file (1).txt"
+)
+
+// ParseCollisionPolicy checks the name of a collision policy.
+func ParseCollisionPolicy(name string) (CollisionPolicy, error) {
+	switch policy := CollisionPolicy(strings.ToLower(name)); policy {
+	case CollisionSkip, CollisionOverwrite, CollisionRename:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown collision policy %q, use skip, overwrite or rename", name)
+	}
+}
+
+// CommonDir returns the deepest directory that contains all the files, as an absolute path.
+// It returns an empty string if the files have nothing in common, such as different drives on Windows.
+func CommonDir(files []string) (string, error) {
+	separator := string(filepath.Separator)
+	var common []string
+	for i, file := range files {
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve %s: %v", file, err)
+		}
+		parts := strings.Split(filepath.Dir(absPath), separator)
+		if i == 0 {
+			common = parts
+			continue
+		}
+
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	if len(common) == 0 {
+		return "", nil
+	}
+
+	// Joining the root alone gives "" or a bare volume name like "C:"
+	dir := strings.Join(common, separator)
+	if dir == filepath.VolumeName(dir) {
+		dir += separator
+	}
+	return dir, nil
+}
+
+// OutputPath returns the path of the output file called name that is produced from filePath.
+// Without an outputDir it sits next to filePath. Otherwise it goes into outputDir, at the same
+// place relative to baseDir as filePath, and any missing directories are created.
+func OutputPath(filePath, name, outputDir, baseDir string) (string, error) {
+	if outputDir == "" {
+		return filepath.Join(filepath.Dir(filePath), name), nil
+	}
+
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %v", filePath, err)
+	}
+	relDir, err := filepath.Rel(baseDir, filepath.Dir(absPath))
+	if err != nil || relDir == ".." || strings.HasPrefix(relDir, ".."+string(filepath.Separator)) {
+		relDir = "." // Not below baseDir, keep only the file name
+	}
+
+	dir := filepath.Join(outputDir, relDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %v", err)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// OutputNames applies the collision policy to the outputs of a batch. It remembers every path it
+// hands out, so two inputs that map to the same output never both get it, even when they are
+// processed at the same time and neither output has been written yet.
+type OutputNames struct {
+	mu      sync.Mutex
+	policy  CollisionPolicy
+	claimed map[string]bool // Absolute paths handed out in this batch
+}
+
+// NewOutputNames returns an empty set of output names that applies the policy.
+func NewOutputNames(policy CollisionPolicy) *OutputNames {
+	return &OutputNames{policy: policy, claimed: make(map[string]bool)}
+}
+
+// Resolve applies the policy to an output path and claims the result. It returns the path to write
+// to, or an empty string if the output already exists and should be skipped. A path handed out
+// earlier in the batch is never overwritten, the policy only replaces files that existed before.
+func (n *OutputNames) Resolve(path string) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resolved, err := n.resolve(path)
+	if err != nil || resolved == "" {
+		return resolved, err
+	}
+	key, err := filepath.Abs(resolved)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %v", resolved, err)
+	}
+	n.claimed[key] = true
+	return resolved, nil
+}
+
+// resolve works out the path to write to, see Resolve.
+func (n *OutputNames) resolve(path string) (string, error) {
+	claimed, err := n.isClaimed(path)
+	if err != nil {
+		return "", err
+	}
+	if claimed {
+		switch n.policy {
+		case CollisionSkip:
+			return "", nil
+		case CollisionRename:
+			return n.freePath(path)
+		default:
+			return "", fmt.Errorf("%s is already the output of another input", path)
+		}
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not access %s: %v", path, err)
+	}
+
+	switch n.policy {
+	case CollisionSkip:
+		return "", nil
+	case CollisionRename:
+		return n.freePath(path)
+	default:
+		return path, nil
+	}
+}
+
+// isClaimed reports whether path was handed out earlier in the batch.
+func (n *OutputNames) isClaimed(path string) (bool, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return false, fmt.Errorf("could not resolve %s: %v", path, err)
+	}
+	return n.claimed[key], nil
+}
+
+// freePath finds an unused variant of path by adding a number before its extension, skipping the
+// names already handed out in the batch. The extension in front of .enc or .age is kept too, so
+// "a.txt.enc" becomes "a (1).txt.enc".
+func (n *OutputNames) freePath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	if ext == ".enc" || ext == ".age" {
+		ext = filepath.Ext(strings.TrimSuffix(path, ext)) + ext
+	}
+	stem := strings.TrimSuffix(path, ext)
+
+	for i := 1; i < 10000; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if claimed, err := n.isClaimed(candidate); err != nil || claimed {
+			continue
+		}
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free name found for %s", path)
+}
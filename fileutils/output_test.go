@@ -0,0 +1,132 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// touch creates an empty file and any missing directories above it
+func touch(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("Failed to create %s: %v", path, err)
+	}
+}
+
+// TestOutputPathLayout tests that nested inputs keep their layout below a missing output directory
+func TestOutputPathLayout(t *testing.T) {
+	root := t.TempDir()
+	files := []string{
+		filepath.Join(root, "docs", "a.txt"),
+		filepath.Join(root, "docs", "sub", "b.txt"),
+		filepath.Join(root, "docs", "sub", "deeper", "c.txt"),
+	}
+	baseDir, err := CommonDir(files)
+	if err != nil || baseDir != filepath.Join(root, "docs") {
+		t.Fatalf("Expected common directory %s, got %s: %v", filepath.Join(root, "docs"), baseDir, err)
+	}
+
+	outputDir := filepath.Join(root, "out", "missing")
+	want := []string{
+		filepath.Join(outputDir, "a.txt.enc"),
+		filepath.Join(outputDir, "sub", "b.txt.enc"),
+		filepath.Join(outputDir, "sub", "deeper", "c.txt.enc"),
+	}
+	for i, file := range files {
+		path, err := OutputPath(file, filepath.Base(file)+".enc", outputDir, baseDir)
+		if err != nil {
+			t.Fatalf("Failed to get output path of %s: %v", file, err)
+		}
+		if path != want[i] {
+			t.Errorf("Expected %s, got %s", want[i], path)
+		}
+		if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			t.Errorf("Expected %s to be created: %v", filepath.Dir(path), err)
+		}
+	}
+
+	// Without an output directory the output sits next to the input
+	if path, err := OutputPath(files[1], "b.txt.enc", "", ""); err != nil || path != files[1]+".enc" {
+		t.Errorf("Expected %s, got %s: %v", files[1]+".enc", path, err)
+	}
+
+	// An input outside the base directory keeps only its name
+	outside := filepath.Join(root, "other", "d.txt")
+	if path, err := OutputPath(outside, "d.txt.enc", outputDir, baseDir); err != nil || path != filepath.Join(outputDir, "d.txt.enc") {
+		t.Errorf("Expected %s, got %s: %v", filepath.Join(outputDir, "d.txt.enc"), path, err)
+	}
+}
+
+// TestOutputNamesPolicy tests each collision policy against a file that already exists
+func TestOutputNamesPolicy(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "a.txt.enc")
+	touch(t, existing)
+	touch(t, filepath.Join(dir, "a (1).txt.enc"))
+	free := filepath.Join(dir, "b.txt.enc")
+
+	tests := []struct {
+		policy CollisionPolicy
+		want   string
+	}{
+		{CollisionSkip, ""},
+		{CollisionOverwrite, existing},
+		{CollisionRename, filepath.Join(dir, "a (2).txt.enc")},
+	}
+	for _, test := range tests {
+		names := NewOutputNames(test.policy)
+		if path, err := names.Resolve(existing); err != nil || path != test.want {
+			t.Errorf("%s: expected %q, got %q: %v", test.policy, test.want, path, err)
+		}
+		if path, err := names.Resolve(free); err != nil || path != free {
+			t.Errorf("%s: expected the free name %s, got %q: %v", test.policy, free, path, err)
+		}
+	}
+
+	if _, err := ParseCollisionPolicy("replace"); err == nil {
+		t.Errorf("Expected an unknown collision policy to be refused")
+	}
+	if policy, err := ParseCollisionPolicy("Rename"); err != nil || policy != CollisionRename {
+		t.Errorf("Expected %s, got %s: %v", CollisionRename, policy, err)
+	}
+}
+
+// TestOutputNamesBatch tests that two inputs of a batch mapping to the same output never share it
+func TestOutputNamesBatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt.enc")
+
+	names := NewOutputNames(CollisionRename)
+	first, err := names.Resolve(path)
+	if err != nil || first != path {
+		t.Fatalf("Expected %s, got %q: %v", path, first, err)
+	}
+	second, err := names.Resolve(path)
+	if want := filepath.Join(dir, "a (1).txt.enc"); err != nil || second != want {
+		t.Errorf("Expected %s, got %q: %v", want, second, err)
+	}
+	third, err := names.Resolve(path)
+	if want := filepath.Join(dir, "a (2).txt.enc"); err != nil || third != want {
+		t.Errorf("Expected %s, got %q: %v", want, third, err)
+	}
+
+	names = NewOutputNames(CollisionSkip)
+	if _, err := names.Resolve(path); err != nil {
+		t.Fatalf("Failed to resolve %s: %v", path, err)
+	}
+	if second, err := names.Resolve(path); err != nil || second != "" {
+		t.Errorf("Expected the second input to be skipped, got %q: %v", second, err)
+	}
+
+	names = NewOutputNames(CollisionOverwrite)
+	if _, err := names.Resolve(path); err != nil {
+		t.Fatalf("Failed to resolve %s: %v", path, err)
+	}
+	if _, err := names.Resolve(path); err == nil {
+		t.Errorf("Expected the second input to be refused rather than overwrite the first")
+	}
+}
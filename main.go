@@ -1,12 +1,16 @@
 package main
 
 import (
-	"flag"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"GoCrypt/encryption"
@@ -19,152 +23,669 @@ import (
 
 var logger *log.Logger
 
-// Main function initializes flags, processes inputs, and handles encryption/decryption based on commands.
+// statusOut receives the CLI status messages. It moves to stderr when stdout carries data.
+var statusOut io.Writer = os.Stdout
+
+// Main function runs gocrypt and exits with the code it returns.
 func main() {
+	os.Exit(run())
+}
+
+// run initializes flags, processes inputs, and handles encryption/decryption based on commands.
+// It returns the process exit code.
+func run() int {
 	// Initialize logger
 	logger = fileutils.InitLogger()
 
 	// Define and parse command-line flags
-	outputDir, noUI, layers := ui.SetupFlags()
+	flags := ui.SetupFlags()
+	jsonReport = flags.JSON
 
 	// Initialize the Fyne app only if necessary
 	var application fyne.App
-	if !*noUI {
+	if !flags.NoUI {
 		application = app.New()
 	}
 
 	// Check if there are enough command-line arguments
-	if len(flag.Args()) < 2 {
-		handleError(application, fmt.Errorf("usage: gocrypt [encrypt|decrypt] [file1 file2 ...] [flags]"), *noUI)
-		return
+	if len(flags.Args) < 1 {
+		return fail(application, fmt.Errorf("usage: gocrypt [encrypt|decrypt|cat|keygen|slots|rekey|calibrate] [file1 file2 ...] [flags]"), flags.NoUI, exitUsage)
+	}
+
+	// Get the command and files from the arguments
+	var err error
+	command := strings.ToLower(flags.Args[0])
+	files := flags.Args[1:]
+
+	// Calibration only measures this machine, it does not need any files
+	if command == "calibrate" {
+		return handleCalibration(application, flags)
+	}
+
+	// A keyfile can replace the password, and recipients or identities take its place, which only works in the terminal
+	if flags.NoPassword && flags.Keyfile == "" {
+		return fail(application, fmt.Errorf("--no-password needs a --keyfile"), flags.NoUI, exitUsage)
+	}
+	if len(flags.Recipients) > 0 && flags.Keyfile != "" {
+		return fail(application, fmt.Errorf("--recipient cannot be combined with --keyfile"), flags.NoUI, exitUsage)
+	}
+	if flags.Passwordless() && !flags.NoUI && !slices.Contains([]string{"cat", "slots", "rekey"}, command) {
+		return fail(application, fmt.Errorf("--no-password, --recipient and --identity only work with --no-ui"), flags.NoUI, exitUsage)
+	}
+
+	// cat prints part of a single file to stdout, keygen writes a keyfile, and slots and rekey change
+	// the key slots of a file, they always run in the terminal
+	switch command {
+	case "cat":
+		return handleCat(files, flags)
+	case "keygen":
+		return handleKeygen(files, flags)
+	case "slots":
+		return handleSlots(files, flags)
+	case "rekey":
+		return handleRekey(files, flags)
+	}
+
+	if len(files) < 1 {
+		return fail(application, fmt.Errorf("usage: gocrypt [encrypt|decrypt] [file1 file2 ...] [flags]"), flags.NoUI, exitUsage)
 	}
 
 	// Validate maximum layers limit
-	if *layers > 200 {
-		handleError(application, fmt.Errorf("maximum allowed encryption layers is 200"), *noUI)
-		return
+	if flags.Layers > 200 {
+		return fail(application, fmt.Errorf("maximum allowed encryption layers is 200"), flags.NoUI, exitUsage)
 	}
 
-	// Get the command and files from the arguments
-	command := strings.ToLower(flag.Args()[0])
-	files := flag.Args()[1:]
+	// "-" streams from stdin or to stdout, which only works for a single input
+	if flags.OutputDir == fileutils.StdioPath || slices.Contains(files, fileutils.StdioPath) {
+		statusOut = os.Stderr
+		if len(files) > 1 {
+			return fail(application, fmt.Errorf("\"-\" can only be used with a single input"), flags.NoUI, exitUsage)
+		}
+	}
 
-	// Check if all files exist
-	if nonExistentFiles := fileutils.CheckFilesExist(files); len(nonExistentFiles) > 0 {
-		errorMessage := fmt.Sprintf("the following files do not exist:\n%s", strings.Join(files, "\n"))
-		handleError(application, fmt.Errorf("%s", errorMessage), *noUI)
-		return
+	// Check the worker count
+	if flags.Jobs < 1 {
+		return fail(application, fmt.Errorf("--jobs must be at least 1"), flags.NoUI, exitUsage)
+	}
+	if flags.Workers < 0 {
+		return fail(application, fmt.Errorf("--workers must be at least 1, or 0 to pick automatically"), flags.NoUI, exitUsage)
+	}
+	if flags.Workers == 0 {
+		flags.Workers = chunkWorkers(flags.Jobs, len(files))
 	}
 
-	// Function to detect file types
-	// WORK IN PROGRESS
-	/*
-	err := fileutils.CheckFileCommand(files, command)
+	// Work out where the results go
+	output, err := newOutputOptions(files, flags)
 	if err != nil {
-		// Display error either in terminal or UI based on no-ui flag
-		handleError(application, err, *noUI)
-		return
+		return fail(application, err, flags.NoUI, exitUsage)
 	}
-	*/
-	
+
+	// Check if all files exist
+	if nonExistentFiles := fileutils.CheckFilesExist(files); len(nonExistentFiles) > 0 {
+		errorMessage := fmt.Sprintf("the following files do not exist:\n%s", strings.Join(nonExistentFiles, "\n"))
+		return fail(application, fmt.Errorf("%s", errorMessage), flags.NoUI, exitUsage)
+	}
+
 	// Handle the encryption or decryption command
+	var summary *batchSummary
 	switch command {
 	case "encrypt", "enc", "e":
-		handleEncryption(application, files, *outputDir, *noUI, *layers)
+		opts, optsErr := encryptionOptions(flags)
+		if optsErr != nil {
+			return fail(application, optsErr, flags.NoUI, exitUsage)
+		}
+		summary, err = handleEncryption(application, files, flags, output, opts)
 	case "decrypt", "dec", "d":
-		handleDecryption(application, files, *outputDir, *noUI, *layers)
+		opts, optsErr := decryptionOptions(flags)
+		if optsErr != nil {
+			return fail(application, optsErr, flags.NoUI, exitUsage)
+		}
+		summary, err = handleDecryption(application, files, flags, output, opts)
 	default:
-		handleError(application, fmt.Errorf("unknown command: %s\nusage: GoCrypt [encrypt|decrypt] [file1 file2 ...] [flags]", command), *noUI)
+		return fail(application, fmt.Errorf("unknown command: %s\nusage: GoCrypt [encrypt|decrypt|cat|keygen|slots|rekey|calibrate] [file1 file2 ...] [flags]", command), flags.NoUI, exitUsage)
+	}
+	if err != nil {
+		return fail(application, err, flags.NoUI, exitFailure)
+	}
+
+	// Nothing was processed if the password prompt was cancelled
+	if summary == nil {
+		return exitOK
 	}
+	return summary.exitCode()
 }
 
-// handleEncryption manages encryption logic based on whether the UI is enabled or not.
-func handleEncryption(application fyne.App, files []string, outputDir string, noUI bool, layers int) {
-	if noUI {
-		password, err := ui.PromptPasswordCLI()
+// encryptionOptions builds the encryption options from the command-line flags, calibrating the KDF if requested.
+func encryptionOptions(flags *ui.Flags) (encryption.Options, error) {
+	opts := encryption.DefaultOptions(flags.Layers)
+	if flags.ChunkSize == 0 || flags.ChunkSize > 16*1024 {
+		return opts, fmt.Errorf("chunk size must be between 1 and 16384 KiB")
+	}
+	opts.ChunkSize = int(flags.ChunkSize * 1024)
+	opts.Workers = flags.Workers
+	cipher, err := encryption.ParseCipher(flags.Cipher)
+	if err != nil {
+		return opts, err
+	}
+	opts.Cipher = cipher
+	if flags.Keyfile != "" {
+		if opts.Keyfile, err = encryption.ReadKeyfile(flags.Keyfile); err != nil {
+			return opts, err
+		}
+	}
+	for _, key := range flags.Recipients {
+		recipient, err := encryption.ParseX25519Recipient(key)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			return
+			return opts, err
+		}
+		opts.Recipients = append(opts.Recipients, recipient)
+	}
+	switch flags.Format {
+	case "gocrypt":
+	case "age":
+		if opts.Keyfile != nil {
+			return opts, fmt.Errorf("age files cannot require a keyfile")
+		}
+		opts.Format = encryption.FormatAge
+	default:
+		return opts, fmt.Errorf("unknown format %q, use gocrypt or age", flags.Format)
+	}
+	// One code for the whole batch, so there is a single code to write down
+	if flags.Recovery {
+		if opts.Format == encryption.FormatAge {
+			return opts, fmt.Errorf("age files cannot have a recovery code")
+		}
+		if opts.RecoveryCode, err = encryption.GenerateRecoveryCode(); err != nil {
+			return opts, err
+		}
+	}
+	if flags.Cascade != "" {
+		for _, name := range strings.Split(flags.Cascade, ",") {
+			cipher, err := encryption.ParseCipher(strings.TrimSpace(name))
+			if err != nil {
+				return opts, err
+			}
+			opts.Cascade = append(opts.Cascade, cipher)
 		}
+		if len(opts.Cascade) > opts.Layers {
+			return opts, fmt.Errorf("a cascade of %d ciphers needs at least %d layers", len(opts.Cascade), len(opts.Cascade))
+		}
+	}
 
-		encryptFiles(nil, files, []byte(password), layers, false, noUI)
+	opts.KDF, err = kdfOptions(flags)
+	return opts, err
+}
 
+// kdfOptions builds the Argon2id parameters from the command-line flags, calibrating them if requested.
+func kdfOptions(flags *ui.Flags) (encryption.KDFParams, error) {
+	// Check the ranges before converting, so large values cannot wrap around to small ones
+	if flags.KDFThreads > math.MaxUint8 {
+		return encryption.KDFParams{}, fmt.Errorf("maximum allowed KDF threads is 255")
+	}
+	if flags.KDFTime > math.MaxUint32 {
+		return encryption.KDFParams{}, fmt.Errorf("invalid KDF time: %d is too large", flags.KDFTime)
+	}
+	if flags.KDFMemory > math.MaxUint32/1024 {
+		return encryption.KDFParams{}, fmt.Errorf("invalid KDF memory: %d MiB is too large", flags.KDFMemory)
+	}
+	params := encryption.KDFParams{
+		Time:    uint32(flags.KDFTime),
+		Memory:  uint32(flags.KDFMemory * 1024),
+		Threads: uint8(flags.KDFThreads),
+	}
+	if err := params.Validate(); err != nil {
+		return params, err
+	}
+	if flags.KDFTarget > 0 {
+		calibrated, err := encryption.CalibrateKDF(flags.KDFTarget, params.Memory, params.Threads)
+		if err != nil {
+			return params, fmt.Errorf("KDF calibration failed: %v", err)
+		}
+		logger.Printf("Calibrated KDF to time %d, memory %d MiB, threads %d", calibrated.Time, calibrated.Memory/1024, calibrated.Threads)
+		params = calibrated
+	}
+	return params, nil
+}
+
+// decryptionOptions builds the decryption options from the command-line flags.
+func decryptionOptions(flags *ui.Flags) (encryption.DecryptOptions, error) {
+	opts := encryption.DecryptOptions{Workers: flags.Workers}
+	if flags.Keyfile != "" {
+		keyfile, err := encryption.ReadKeyfile(flags.Keyfile)
+		if err != nil {
+			return opts, err
+		}
+		opts.Keyfile = keyfile
+	}
+	if flags.Identity != "" {
+		identities, err := encryption.ReadIdentities(flags.Identity)
+		if err != nil {
+			return opts, err
+		}
+		opts.Identities = identities
+	}
+	return opts, nil
+}
+
+// chunkWorkers shares the CPUs between the files processed at the same time, so a single large file
+// uses every CPU for its chunks while a batch keeps each file on one.
+func chunkWorkers(jobs, fileCount int) int {
+	return max(1, runtime.NumCPU()/min(jobs, fileCount))
+}
+
+// handleCalibration measures the KDF on this machine and reports the flags that hit the target time.
+// It returns the process exit code.
+func handleCalibration(application fyne.App, flags *ui.Flags) int {
+	target := flags.KDFTarget
+	if target <= 0 {
+		target = time.Second
+	}
+
+	params, err := encryption.CalibrateKDF(target, uint32(flags.KDFMemory*1024), uint8(flags.KDFThreads))
+	if err != nil {
+		return fail(application, fmt.Errorf("KDF calibration failed: %v", err), flags.NoUI, exitFailure)
+	}
+
+	message := fmt.Sprintf("Use --kdf-time %d --kdf-memory %d --kdf-threads %d for about %s per key on this machine.", params.Time, params.Memory/1024, params.Threads, target)
+	logger.Println(message)
+	if flags.NoUI {
+		fmt.Println(message)
 	} else {
-		ui.ShowPasswordPrompt(application, "encrypt", "chacha20poly1305", strings.Join(files, "\n"), func(password string, deleteAfter bool) {
-			encryptFiles(application, files, []byte(password), layers, deleteAfter, noUI)
-		})
+		ui.ShowInfoDialog(application, "KDF Calibration", message)
 	}
+	return exitOK
 }
 
-// handleDecryption manages decryption logic based on whether the UI is enabled or not.
-func handleDecryption(application fyne.App, files []string, outputDir string, noUI bool, layers int) {
-	if noUI {
-		password, err := ui.PromptPasswordCLI()
+// handleCat decrypts the range given by --offset and --length of a single file to stdout,
+// reading only the chunks that cover it. It returns the process exit code.
+func handleCat(files []string, flags *ui.Flags) int {
+	statusOut = os.Stderr
+	if len(files) != 1 || files[0] == fileutils.StdioPath {
+		return fail(nil, fmt.Errorf("usage: gocrypt cat [--offset n] [--length n] file"), true, exitUsage)
+	}
+	if flags.Offset < 0 {
+		return fail(nil, fmt.Errorf("--offset must not be negative"), true, exitUsage)
+	}
+
+	inputFile, err := os.Open(files[0])
+	if err != nil {
+		return fail(nil, fmt.Errorf("error opening input file: %w", err), true, exitFailure)
+	}
+	defer inputFile.Close()
+	info, err := inputFile.Stat()
+	if err != nil {
+		return fail(nil, fmt.Errorf("error opening input file: %w", err), true, exitFailure)
+	}
+
+	opts, err := decryptionOptions(flags)
+	if err != nil {
+		return fail(nil, err, true, exitUsage)
+	}
+	password, err := ui.ReadPasswordCLI(flags, false)
+	if err != nil {
+		return fail(nil, err, true, exitFailure)
+	}
+	reader, err := encryption.NewDecryptReaderAtWithOptions(inputFile, info.Size(), password, opts)
+	if err != nil {
+		// A wrong password needs no details about the layer it was noticed in
+		if errors.Is(err, encryption.ErrWrongPassword) {
+			err = encryption.ErrWrongPassword
+		}
+		err = fmt.Errorf("decryption failed: %w", err)
+		return fail(nil, err, true, exitCodeForClass(errorClass(err)))
+	}
+
+	// A negative length reads to the end, a range past the end prints nothing
+	length := max(reader.Size()-flags.Offset, 0)
+	if flags.Length >= 0 {
+		length = min(length, flags.Length)
+	}
+	if _, err := io.Copy(os.Stdout, io.NewSectionReader(reader, flags.Offset, length)); err != nil {
+		err = fmt.Errorf("decryption failed: %w", err)
+		return fail(nil, err, true, exitCodeForClass(errorClass(err)))
+	}
+	logger.Printf("Printed %d bytes of %s from offset %d", length, files[0], flags.Offset)
+	return exitOK
+}
+
+// handleKeygen writes a new random keyfile to the given path, or to stdout for "-". With --x25519
+// it writes an identity file with a new key pair instead and prints its public key.
+// An existing file is never overwritten. It returns the process exit code.
+func handleKeygen(files []string, flags *ui.Flags) int {
+	if len(files) != 1 {
+		return fail(nil, fmt.Errorf("usage: gocrypt keygen [--x25519] file"), true, exitUsage)
+	}
+
+	kind := "keyfile"
+	generate := encryption.GenerateKeyfile
+	notice := "keep a copy somewhere safe: files encrypted with it cannot be decrypted without it"
+	var publicKey *encryption.X25519Recipient
+	if flags.X25519 {
+		identity, err := encryption.GenerateX25519Identity()
+		if err != nil {
+			return fail(nil, err, true, exitFailure)
+		}
+		kind = "identity"
+		generate = func(dest io.Writer) error {
+			_, err := fmt.Fprintf(dest, "# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), identity.Recipient(), identity)
+			return err
+		}
+		notice = "keep a copy somewhere safe: files encrypted to its public key cannot be decrypted without it"
+		publicKey = identity.Recipient()
+	}
+
+	if files[0] == fileutils.StdioPath {
+		statusOut = os.Stderr
+		if err := generate(os.Stdout); err != nil {
+			return fail(nil, err, true, exitFailure)
+		}
+		if publicKey != nil {
+			fmt.Fprintf(statusOut, "Public key: %s\n", publicKey)
+		}
+		return exitOK
+	}
+
+	keyFile, err := os.OpenFile(files[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fail(nil, fmt.Errorf("failed to create %s: %w", kind, err), true, exitFailure)
+	}
+	if err := generate(keyFile); err != nil {
+		keyFile.Close()
+		os.Remove(files[0])
+		return fail(nil, fmt.Errorf("failed to write %s: %w", kind, err), true, exitFailure)
+	}
+	if err := keyFile.Close(); err != nil {
+		return fail(nil, fmt.Errorf("failed to write %s: %w", kind, err), true, exitFailure)
+	}
+
+	logger.Printf("New %s written to %s", kind, files[0])
+	fmt.Fprintf(statusOut, "New %s written to %s, %s\n", kind, files[0], notice)
+	if publicKey != nil {
+		fmt.Fprintf(statusOut, "Public key: %s\n", publicKey)
+	}
+	return exitOK
+}
+
+// handleSlots lists, adds or removes the key slots of a single file. Adding and removing rewrite
+// only the header, they need the password, keyfile or identity of another slot. It returns the
+// process exit code.
+func handleSlots(args []string, flags *ui.Flags) int {
+	usage := fmt.Errorf("usage: gocrypt slots list|add|remove file, remove needs --slot n")
+	if len(args) != 2 || args[1] == fileutils.StdioPath {
+		return fail(nil, usage, true, exitUsage)
+	}
+	action, path := strings.ToLower(args[0]), args[1]
+
+	if action == "list" {
+		slots, err := encryption.ReadKeySlots(path)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			return
+			return fail(nil, fmt.Errorf("failed to read key slots: %w", err), true, exitCodeForClass(errorClass(err)))
 		}
+		for i, slot := range slots {
+			fmt.Printf("Slot %d: %s\n", i, describeSlot(slot))
+		}
+		return exitOK
+	}
+	if action != "add" && action != "remove" {
+		return fail(nil, usage, true, exitUsage)
+	}
+	if action == "remove" && flags.Slot < 0 {
+		return fail(nil, usage, true, exitUsage)
+	}
 
-		decryptFiles(nil, files, []byte(password), layers, false, noUI)
+	opts, err := decryptionOptions(flags)
+	if err != nil {
+		return fail(nil, err, true, exitUsage)
+	}
+	password, err := ui.ReadPasswordCLI(flags, false)
+	if err != nil {
+		return fail(nil, err, true, exitFailure)
+	}
 
+	if action == "add" {
+		slot, slotErr := newPasswordSlot(flags)
+		if slotErr != nil {
+			return fail(nil, slotErr, true, exitUsage)
+		}
+		err = encryption.AddKeySlot(path, password, opts, slot)
 	} else {
-		ui.ShowPasswordPrompt(application, "decrypt", "chacha20poly1305", strings.Join(files, "\n"), func(password string, deleteAfter bool) {
-			decryptFiles(application, files, []byte(password), layers, deleteAfter, noUI)
-		})
+		err = encryption.RemoveKeySlot(path, password, opts, flags.Slot)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to %s key slot: %w", action, err)
+		return fail(nil, err, true, exitCodeForClass(errorClass(err)))
 	}
+
+	message := fmt.Sprintf("Key slot added to %s", path)
+	if action == "remove" {
+		message = fmt.Sprintf("Key slot %d removed from %s", flags.Slot, path)
+	}
+	logger.Println(message)
+	fmt.Fprintln(statusOut, message)
+	return exitOK
 }
 
-// encryptFiles performs the encryption on the provided files using the specified password and options.
-func encryptFiles(application fyne.App, files []string, key []byte, layers int, deleteAfter bool, noUI bool) {
-	var wg sync.WaitGroup
-	startTime := time.Now() // Track the time for the entire encryption process
-	success := true
-
-	for index, filePath := range files {
-		wg.Add(1)
-		go func(index int, filePath string) {
-			defer wg.Done()
-			err := performFileEncryption(index, filePath, key, layers, deleteAfter, len(files))
-			if (err != nil) {
-				success = false
-				//handleError(application, err, noUI)
-				fmt.Println(err)
-				logger.Println(err)
+// handleRekey replaces the key slot of the current password of a single file with the new password
+// from the --new-* flags, rewriting only its header. It returns the process exit code.
+func handleRekey(files []string, flags *ui.Flags) int {
+	if len(files) != 1 || files[0] == fileutils.StdioPath {
+		return fail(nil, fmt.Errorf("usage: gocrypt rekey file"), true, exitUsage)
+	}
+	if flags.Identity != "" {
+		return fail(nil, fmt.Errorf("rekey changes a password slot, use slots add and remove for recipients"), true, exitUsage)
+	}
+
+	opts, err := decryptionOptions(flags)
+	if err != nil {
+		return fail(nil, err, true, exitUsage)
+	}
+	password, err := ui.ReadPasswordCLI(flags, false)
+	if err != nil {
+		return fail(nil, err, true, exitFailure)
+	}
+	slot, err := newPasswordSlot(flags)
+	if err != nil {
+		return fail(nil, err, true, exitUsage)
+	}
+
+	if err := encryption.Rekey(files[0], password, opts, slot); err != nil {
+		err = fmt.Errorf("rekey failed: %w", err)
+		return fail(nil, err, true, exitCodeForClass(errorClass(err)))
+	}
+	logger.Printf("Rekeyed %s", files[0])
+	fmt.Fprintf(statusOut, "Rekeyed %s, the old password no longer opens it\n", files[0])
+	return exitOK
+}
+
+// newPasswordSlot builds a new key slot from the --new-* and KDF flags.
+func newPasswordSlot(flags *ui.Flags) (encryption.PasswordSlot, error) {
+	var slot encryption.PasswordSlot
+	var err error
+	if slot.KDF, err = kdfOptions(flags); err != nil {
+		return slot, err
+	}
+	if flags.NewKeyfile != "" {
+		if slot.Keyfile, err = encryption.ReadKeyfile(flags.NewKeyfile); err != nil {
+			return slot, err
+		}
+	}
+	slot.Password, err = ui.ReadNewPasswordCLI(flags)
+	return slot, err
+}
+
+// describeSlot returns what opens a key slot, as shown by slots list.
+func describeSlot(slot encryption.KeySlot) string {
+	if slot.Recipient {
+		return "X25519 recipient"
+	}
+	if slot.Recovery {
+		return "recovery code"
+	}
+	kind := "password"
+	if slot.Keyfile {
+		kind = "password and keyfile"
+	}
+	return fmt.Sprintf("%s (Argon2id time %d, memory %d MiB, threads %d)", kind, slot.KDF.Time, slot.KDF.Memory/1024, slot.KDF.Threads)
+}
+
+// outputOptions describes where the results of encryption and decryption are written.
+type outputOptions struct {
+	dir     string                 // Output directory, empty to write next to the inputs or "-" for stdout
+	baseDir string                 // Common parent of the inputs, their layout below it is kept inside dir
+	names   *fileutils.OutputNames // Shared by the workers of the batch, so no two inputs get the same output
+}
+
+// newOutputOptions builds the output options from the command-line flags.
+func newOutputOptions(files []string, flags *ui.Flags) (outputOptions, error) {
+	output := outputOptions{dir: flags.OutputDir}
+	collision, err := fileutils.ParseCollisionPolicy(flags.Collision)
+	if err != nil {
+		return output, err
+	}
+	output.names = fileutils.NewOutputNames(collision)
+
+	// Data read from stdin is always written to stdout, an output directory would be ignored
+	if slices.Contains(files, fileutils.StdioPath) {
+		if output.dir != "" && output.dir != fileutils.StdioPath {
+			return output, fmt.Errorf("-o %s cannot be used with \"-\" as the input, its output goes to stdout", output.dir)
+		}
+		return output, nil
+	}
+	if output.dir != "" && output.dir != fileutils.StdioPath {
+		if output.baseDir, err = fileutils.CommonDir(files); err != nil {
+			return output, err
+		}
+	}
+	return output, nil
+}
+
+// toStdout reports whether the output is written to stdout.
+func (o outputOptions) toStdout() bool {
+	return o.dir == fileutils.StdioPath
+}
+
+// path returns where the output called name for filePath is written, after applying the
+// collision policy. It returns an empty string if the file should be skipped.
+func (o outputOptions) path(filePath, name string) (string, error) {
+	outputPath, err := fileutils.OutputPath(filePath, name, o.dir, o.baseDir)
+	if err != nil {
+		return "", err
+	}
+	return o.names.Resolve(outputPath)
+}
+
+// handleEncryption manages encryption logic based on whether the UI is enabled or not.
+// It returns the results, or nil if the password prompt was cancelled.
+func handleEncryption(application fyne.App, files []string, flags *ui.Flags, output outputOptions, opts encryption.Options) (*batchSummary, error) {
+	noUI := flags.NoUI
+	if noUI {
+		password, err := ui.ReadPasswordCLI(flags, slices.Contains(files, fileutils.StdioPath))
+		if err != nil {
+			return nil, err
+		}
+
+		// The code goes to stderr so it reaches the terminal, not a pipe or the JSON report
+		if opts.RecoveryCode != "" {
+			fmt.Fprintf(os.Stderr, "Recovery code: %s\n", opts.RecoveryCode)
+			if len(files) > 1 {
+				fmt.Fprintf(os.Stderr, "Warning: this one code unlocks all %d files of this batch.\n", len(files))
 			}
-		}(index, filePath)
+			fmt.Fprintln(os.Stderr, "Write it down and keep it apart from the files: it opens them without the password and is not shown again.")
+		}
+		return encryptFiles(nil, files, output, []byte(password), opts, false, noUI, flags.Jobs), nil
 	}
 
-	wg.Wait()
-	if success {
-		fmt.Printf("All files encrypted successfully in: %s", time.Since(startTime))
-		logger.Printf("All files encrypted successfully in: %s", time.Since(startTime))
+	// The prompt blocks until its window is closed, the summary stays nil if it was cancelled
+	var summary *batchSummary
+	ui.ShowPasswordPrompt(application, "encrypt", strings.Join(files, "\n"), opts.RecoveryCode, func(password string, deleteAfter bool) {
+		summary = encryptFiles(application, files, output, []byte(password), opts, deleteAfter, noUI, flags.Jobs)
+	})
+	return summary, nil
+}
+
+// handleDecryption manages decryption logic based on whether the UI is enabled or not.
+// It returns the results, or nil if the password prompt was cancelled.
+func handleDecryption(application fyne.App, files []string, flags *ui.Flags, output outputOptions, opts encryption.DecryptOptions) (*batchSummary, error) {
+	noUI := flags.NoUI
+	if noUI {
+		password, err := ui.ReadPasswordCLI(flags, slices.Contains(files, fileutils.StdioPath))
+		if err != nil {
+			return nil, err
+		}
+
+		return decryptFiles(nil, files, output, []byte(password), opts, false, noUI, flags.Jobs), nil
 	}
+
+	// The prompt blocks until its window is closed, the summary stays nil if it was cancelled
+	var summary *batchSummary
+	ui.ShowPasswordPrompt(application, "decrypt", strings.Join(files, "\n"), "", func(password string, deleteAfter bool) {
+		summary = decryptFiles(application, files, output, []byte(password), opts, deleteAfter, noUI, flags.Jobs)
+	})
+	return summary, nil
+}
+
+// encryptFiles performs the encryption on the provided files using the specified password and options.
+func encryptFiles(application fyne.App, files []string, output outputOptions, key []byte, opts encryption.Options, deleteAfter bool, noUI bool, jobs int) *batchSummary {
+	summary := runBatch(files, jobs, func(index int, filePath string) (string, int64, error) {
+		return performFileEncryption(index, filePath, output, key, opts, deleteAfter, len(files))
+	})
+	summary.report("encrypted")
+	return summary
 }
 
 // performFileEncryption handles encryption of a single file and reports the status.
-func performFileEncryption(index int, filePath string, key []byte, layers int, deleteAfter bool, fileLength int) error {
+func performFileEncryption(index int, filePath string, output outputOptions, key []byte, opts encryption.Options, deleteAfter bool, fileLength int) (string, int64, error) {
 	startTime := time.Now()
 	isDir := false // Track if the file is a directory
 
+	// Data from stdin is always written to stdout
+	if filePath == fileutils.StdioPath {
+		stdin := &countingReader{reader: os.Stdin}
+		if err := encryptStream(os.Stdout, stdin, key, opts); err != nil {
+			return "", 0, fmt.Errorf("error encrypting stdin: %w", err)
+		}
+		logger.Printf("stdin encrypted successfully in %s\n", time.Since(startTime))
+		return fileutils.StdioPath, stdin.count, nil
+	}
+
 	// Skip already encrypted files
-	//FIXME: update with IsFileEncrypted function in fileutils
-	if strings.HasSuffix(filePath, ".enc") {
-		logger.Printf("file %s is already encrypted. Skipping... ", filePath)
-		return nil
+	if encrypted, _ := fileutils.IsFileEncrypted(filePath); encrypted {
+		return "", 0, skipFile("already encrypted")
 	}
 
 	// Check if the file is protected
 	if fileutils.IsFileProtected(filePath) {
-		logger.Printf("skipping protected file: %s", filePath)
-		return nil
+		return "", 0, skipFile("protected file")
+	}
+
+	// Directories are encrypted as a zip of their contents
+	isDir = fileutils.IsDirectory(filePath)
+	ext := ".enc"
+	if opts.Format == encryption.FormatAge {
+		ext = ".age"
+	}
+	outputName := filepath.Base(filePath) + ext
+	if isDir {
+		outputName = filepath.Base(filePath) + ".zip" + ext
+	}
+
+	// Work out the output path before doing any work, unless it goes to stdout
+	outputPath := fileutils.StdioPath
+	if !output.toStdout() {
+		var err error
+		if outputPath, err = output.path(filePath, outputName); err != nil {
+			return "", 0, fmt.Errorf("error preparing output: %w", err)
+		}
+		if outputPath == "" {
+			return "", 0, skipFile("output already exists")
+		}
 	}
 
 	// If it's a directory, compress it first
-	if fileutils.IsDirectory(filePath) {
-		isDir = true
+	if isDir {
 		zipPath := filePath + ".zip"
 		if err := fileutils.CompressFolder(filePath, zipPath); err != nil {
-			return fmt.Errorf("error compressing folder: %v", err)
+			return "", 0, fmt.Errorf("error compressing folder: %w", err)
 		}
 		filePath = zipPath
 	}
@@ -172,98 +693,161 @@ func performFileEncryption(index int, filePath string, key []byte, layers int, d
 	// Open the input file for encryption
 	inputFile, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("error opening input file: %v", err)
+		return "", 0, fmt.Errorf("error opening input file: %w", err)
 	}
 	defer inputFile.Close()
 
-	// Perform encryption
-	outputPath := filePath + ".enc"
-	if err := encryption.LayeredEncryptFile(inputFile, outputPath, string(key), layers); err != nil {
-		return fmt.Errorf("error encrypting file: %v", err)
+	// Record the input size for the report
+	var size int64
+	if info, err := inputFile.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	// Perform encryption, straight to stdout if that is the output
+	toStdout := output.toStdout()
+	if toStdout {
+		err = encryptStream(os.Stdout, inputFile, key, opts)
+	} else {
+		err = encryption.LayeredEncryptFileWithOptions(inputFile, outputPath, string(key), opts)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("error encrypting file: %w", err)
 	}
 	
 	inputFile.Close()	// Ensure file is closed
 
-	// Optionally delete the original file
-	if deleteAfter || isDir {
+	// Optionally delete the original file, the zip of a directory is always removed
+	// Nothing is deleted after writing to stdout, the reader may still fail
+	if (deleteAfter && !toStdout) || isDir {
 		logger.Printf("Deleting the following item during encryption: %v", filePath)
 		if err := fileutils.DeleteFile(filePath); err != nil {
-			return fmt.Errorf("error deleting file: %v", err)
+			return "", 0, fmt.Errorf("error deleting file: %w", err)
 		}
 	}
 	
 	logger.Printf("File %d / %d encrypted successfully in %s\n", index+1, fileLength, time.Since(startTime))
-	return nil
+	return outputPath, size, nil
 }
 
-// decryptFiles performs the decryption on the provided files using the specified password.
-func decryptFiles(application fyne.App, files []string, key []byte, layers int, deleteAfter bool, noUI bool) {
-	var wg sync.WaitGroup
-	startTime := time.Now()
-	success := true
-
-	for index, filePath := range files {
-		wg.Add(1)
-		go func(index int, filePath string) {
-			defer wg.Done()
-			err := performFileDecryption(index, filePath, key, deleteAfter, len(files))
-			if (err != nil) {
-				success = false
-				//handleError(application, err, noUI)
-				fmt.Println(err)
-				logger.Println(err)
-			}
-		}(index, filePath)
+// encryptStream encrypts everything read from source and writes the encrypted file to dest.
+func encryptStream(dest io.Writer, source io.Reader, key []byte, opts encryption.Options) error {
+	writer, err := encryption.NewEncryptWriter(dest, string(key), opts)
+	if err != nil {
+		return err
 	}
-
-	wg.Wait()
-	if success {
-		fmt.Printf("All files decrypted successfully in: %s", time.Since(startTime))
-		logger.Printf("All files decrypted successfully in: %s", time.Since(startTime))
+	if _, err := io.Copy(writer, source); err != nil {
+		return err
 	}
+	return writer.Close()
+}
+
+// decryptFiles performs the decryption on the provided files using the specified password.
+func decryptFiles(application fyne.App, files []string, output outputOptions, key []byte, opts encryption.DecryptOptions, deleteAfter bool, noUI bool, jobs int) *batchSummary {
+	summary := runBatch(files, jobs, func(index int, filePath string) (string, int64, error) {
+		return performFileDecryption(index, filePath, output, key, opts, deleteAfter, len(files))
+	})
+	summary.report("decrypted")
+	return summary
 }
 
 // performFileDecryption handles decryption of a single file and reports the status.
-func performFileDecryption(index int, filePath string, key []byte, deleteAfter bool, fileLength int) error{
+func performFileDecryption(index int, filePath string, output outputOptions, key []byte, opts encryption.DecryptOptions, deleteAfter bool, fileLength int) (string, int64, error) {
 	startTime := time.Now()
+
+	// Data from stdin is always written to stdout
+	if filePath == fileutils.StdioPath {
+		stdin := &countingReader{reader: os.Stdin}
+		if err := decryptStream(os.Stdout, stdin, key, opts); err != nil {
+			return "", 0, fmt.Errorf("decryption failed: %w", err)
+		}
+		logger.Printf("stdin decrypted successfully in %s\n", time.Since(startTime))
+		return fileutils.StdioPath, stdin.count, nil
+	}
 	
-	// Skip files that are not encrypted
-	// FIXME: Replace with IsFileEncrypted method
-	if !strings.HasSuffix(filePath, ".enc") {
-		logger.Printf("file %s is not encrypted. Skipping... ", filePath)
-		return nil
+	// Skip files that are not encrypted, and refuse headers we do not understand
+	encrypted, err := fileutils.IsFileEncrypted(filePath)
+	if err != nil {
+		return "", 0, fmt.Errorf("decryption failed: %w", err)
+	}
+	if !encrypted {
+		return "", 0, skipFile("not encrypted")
+	}
+
+	// Work out the output path, files without the .enc or .age extension get a .dec extension instead
+	toStdout := output.toStdout()
+	outputPath := fileutils.StdioPath
+	if !toStdout {
+		outputName := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(filePath), ".enc"), ".age")
+		if outputName == filepath.Base(filePath) {
+			outputName += ".dec"
+		}
+		if outputPath, err = output.path(filePath, outputName); err != nil {
+			return "", 0, fmt.Errorf("error preparing output: %w", err)
+		}
+		if outputPath == "" {
+			return "", 0, skipFile("output already exists")
+		}
 	}
 
 	// Open the input file for decryption
 	inputFile, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("error opening input file: %v", err)
+		return "", 0, fmt.Errorf("error opening input file: %w", err)
 	}
 	defer inputFile.Close()
 
+	// Record the input size for the report
+	var size int64
+	if info, err := inputFile.Stat(); err == nil {
+		size = info.Size()
+	}
+
 	// Perform decryption
-	outputPath := strings.TrimSuffix(filePath, ".enc")
-	err = encryption.LayeredDecryptFile(inputFile, outputPath, string(key))
+	if toStdout {
+		err = decryptStream(os.Stdout, inputFile, key, opts)
+	} else {
+		err = encryption.LayeredDecryptFileWithOptions(inputFile, outputPath, string(key), opts)
+	}
 	if err != nil {
-		// Check if it's an incorrect password error
-		if strings.Contains(err.Error(), "cipher: message authentication failed") {
-			return fmt.Errorf("decryption failed: incorrect password")
-		} else {
-			return fmt.Errorf("decryption failed: %v", err)
+		// A wrong password needs no details about the layer it was noticed in
+		if errors.Is(err, encryption.ErrWrongPassword) {
+			return "", 0, fmt.Errorf("decryption failed: %w", encryption.ErrWrongPassword)
 		}
+		return "", 0, fmt.Errorf("decryption failed: %w", err)
 	}
 
 	inputFile.Close()	// Ensure file is closed	
 
-	// Optionally delete the encrypted file
-	if deleteAfter {
+	// Optionally delete the encrypted file, but not after writing to stdout
+	if deleteAfter && !toStdout {
 		if err := fileutils.DeleteFile(filePath); err != nil {
 			logger.Printf("Deleting the following item during decryption: %v", filePath)
-			return fmt.Errorf("error deleting file: %v", err)
+			return "", 0, fmt.Errorf("error deleting file: %w", err)
 		}
 	}
 	logger.Printf("File %d / %d decrypted successfully in %s\n", index+1, fileLength, time.Since(startTime))
-	return nil
+	return outputPath, size, nil
+}
+
+// decryptStream decrypts the encrypted file read from source and writes the plaintext to dest.
+func decryptStream(dest io.Writer, source io.Reader, key []byte, opts encryption.DecryptOptions) error {
+	reader, err := encryption.NewDecryptReaderWithOptions(source, string(key), opts)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, reader)
+	return err
+}
+
+// fail reports an error that stops gocrypt and returns the exit code for it.
+func fail(application fyne.App, err error, noUI bool, code int) int {
+	if jsonReport && noUI {
+		logger.Printf("Error: %v\n", err)
+		writeErrorJSON(statusOut, err, code)
+		return code
+	}
+	handleError(application, err, noUI)
+	return code
 }
 
 func handleError(application fyne.App, err error, noUI bool) {
@@ -271,7 +855,7 @@ func handleError(application fyne.App, err error, noUI bool) {
 	logger.Printf("Error: %v\n", err)
 
     if noUI {
-        fmt.Printf("Error: %v\n", err)
+        fmt.Fprintf(statusOut, "Error: %v\n", err)
     } else {
         ui.ShowErrorDialog(application, err.Error())
     }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"GoCrypt/encryption"
+)
+
+// Process exit codes, so scripts can tell what went wrong.
+const (
+	exitOK            = 0
+	exitFailure       = 1 // Any other error, such as a file that could not be read or written
+	exitUsage         = 2 // Invalid arguments or flags
+	exitWrongPassword = 3 // The password, keyfile or identity did not decrypt the input
+	exitCorrupt       = 4 // The input is damaged, truncated or not in a format we can read
+	exitPartial       = 5 // Some files were processed and others failed
+)
+
+// Error classes reported in the JSON records.
+const (
+	classWrongPassword = "wrong_password"
+	classCorrupt       = "corrupt"
+	classIO            = "io"
+	classUsage         = "usage"
+	classOther         = "other"
+)
+
+// jsonReport switches the CLI output to one JSON record per line.
+var jsonReport bool
+
+// errorClass sorts a failure into one of the error classes.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, encryption.ErrWrongPassword), errors.Is(err, encryption.ErrKeyfileRequired),
+		errors.Is(err, encryption.ErrIdentityRequired), errors.Is(err, encryption.ErrNoMatchingIdentity):
+		return classWrongPassword
+	case errors.Is(err, encryption.ErrCorrupted), errors.Is(err, encryption.ErrTruncated),
+		errors.Is(err, encryption.ErrUnsupportedVersion), errors.Is(err, encryption.ErrNotGoCrypt):
+		return classCorrupt
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission), errors.Is(err, fs.ErrExist):
+		return classIO
+	default:
+		return classOther
+	}
+}
+
+// exitCodeForClass maps an error class to the process exit code.
+func exitCodeForClass(class string) int {
+	switch class {
+	case classWrongPassword:
+		return exitWrongPassword
+	case classCorrupt:
+		return exitCorrupt
+	case classUsage:
+		return exitUsage
+	default:
+		return exitFailure
+	}
+}
+
+// exitCode returns the exit code for the batch. Failures next to successes are a partial failure,
+// otherwise the failures decide the code if they all have the same class.
+func (s *batchSummary) exitCode() int {
+	if s.count(statusFailed) == 0 {
+		return exitOK
+	}
+	if s.count(statusSucceeded) > 0 {
+		return exitPartial
+	}
+
+	class := ""
+	for _, result := range s.results {
+		if result.status != statusFailed {
+			continue
+		}
+		if resultClass := errorClass(result.err); class == "" {
+			class = resultClass
+		} else if resultClass != class {
+			return exitFailure
+		}
+	}
+	return exitCodeForClass(class)
+}
+
+// fileRecord is the JSON record written for every input.
+type fileRecord struct {
+	Type       string  `json:"type"`
+	Input      string  `json:"input"`
+	Output     string  `json:"output,omitempty"`
+	Status     string  `json:"status"`
+	Reason     string  `json:"reason,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	ErrorClass string  `json:"error_class,omitempty"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// summaryRecord is the JSON record written after all inputs of a batch.
+type summaryRecord struct {
+	Type       string  `json:"type"`
+	Succeeded  int     `json:"succeeded"`
+	Skipped    int     `json:"skipped"`
+	Failed     int     `json:"failed"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	ExitCode   int     `json:"exit_code"`
+}
+
+// errorRecord is the JSON record written when gocrypt stops before processing any input.
+type errorRecord struct {
+	Type       string `json:"type"`
+	Error      string `json:"error"`
+	ErrorClass string `json:"error_class"`
+	ExitCode   int    `json:"exit_code"`
+}
+
+// milliseconds converts a duration for the JSON records.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeJSON writes one record per input followed by the summary record.
+func (s *batchSummary) writeJSON(w io.Writer) {
+	encoder := json.NewEncoder(w)
+	var bytes int64
+	for _, result := range s.results {
+		record := fileRecord{
+			Type:       "file",
+			Input:      result.input,
+			Output:     result.output,
+			Bytes:      result.bytes,
+			DurationMS: milliseconds(result.duration),
+		}
+		switch result.status {
+		case statusSucceeded:
+			record.Status = "succeeded"
+		case statusSkipped:
+			record.Status = "skipped"
+			record.Reason = result.err.Error()
+		case statusFailed:
+			record.Status = "failed"
+			record.Error = result.err.Error()
+			record.ErrorClass = errorClass(result.err)
+		}
+		bytes += result.bytes
+		encoder.Encode(record)
+	}
+
+	encoder.Encode(summaryRecord{
+		Type:       "summary",
+		Succeeded:  s.count(statusSucceeded),
+		Skipped:    s.count(statusSkipped),
+		Failed:     s.count(statusFailed),
+		Bytes:      bytes,
+		DurationMS: milliseconds(s.duration),
+		ExitCode:   s.exitCode(),
+	})
+}
+
+// writeErrorJSON writes the record for an error that stopped gocrypt.
+func writeErrorJSON(w io.Writer, err error, code int) {
+	class := classUsage
+	if code != exitUsage {
+		class = errorClass(err)
+	}
+	json.NewEncoder(w).Encode(errorRecord{Type: "error", Error: err.Error(), ErrorClass: class, ExitCode: code})
+}
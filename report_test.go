@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"GoCrypt/encryption"
+)
+
+// TestErrorClass tests that errors, also when wrapped, map to their class and exit code
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+		code  int
+	}{
+		{encryption.ErrWrongPassword, classWrongPassword, exitWrongPassword},
+		{encryption.ErrKeyfileRequired, classWrongPassword, exitWrongPassword},
+		{encryption.ErrNoMatchingIdentity, classWrongPassword, exitWrongPassword},
+		{encryption.ErrCorrupted, classCorrupt, exitCorrupt},
+		{encryption.ErrTruncated, classCorrupt, exitCorrupt},
+		{encryption.ErrNotGoCrypt, classCorrupt, exitCorrupt},
+		{encryption.ErrUnsupportedVersion, classCorrupt, exitCorrupt},
+		{os.ErrNotExist, classIO, exitFailure},
+		{errors.New("disk full"), classOther, exitFailure},
+	}
+	for _, test := range tests {
+		err := fmt.Errorf("file.enc: %w", test.err)
+		if class := errorClass(err); class != test.class {
+			t.Errorf("%v: expected class %s, got %s", test.err, test.class, class)
+		}
+
+		summary := &batchSummary{results: []fileResult{{input: "file.enc", status: statusFailed, err: err}}}
+		if code := summary.exitCode(); code != test.code {
+			t.Errorf("%v: expected exit code %d, got %d", test.err, test.code, code)
+		}
+	}
+}
+
+// TestExitCode tests the exit code of batches with mixed outcomes
+func TestExitCode(t *testing.T) {
+	succeeded := fileResult{status: statusSucceeded}
+	skipped := fileResult{status: statusSkipped, err: skipFile("already encrypted")}
+	wrongPassword := fileResult{status: statusFailed, err: encryption.ErrWrongPassword}
+	corrupt := fileResult{status: statusFailed, err: encryption.ErrCorrupted}
+
+	tests := []struct {
+		name    string
+		results []fileResult
+		code    int
+	}{
+		{"all succeeded", []fileResult{succeeded, succeeded}, exitOK},
+		{"only skipped", []fileResult{skipped}, exitOK},
+		{"skipped and succeeded", []fileResult{succeeded, skipped}, exitOK},
+		{"failed next to succeeded", []fileResult{succeeded, corrupt}, exitPartial},
+		{"failed next to skipped", []fileResult{skipped, wrongPassword}, exitWrongPassword},
+		{"same failures", []fileResult{corrupt, corrupt}, exitCorrupt},
+		{"mixed failures", []fileResult{corrupt, wrongPassword}, exitFailure},
+	}
+	for _, test := range tests {
+		summary := &batchSummary{results: test.results}
+		if code := summary.exitCode(); code != test.code {
+			t.Errorf("%s: expected exit code %d, got %d", test.name, test.code, code)
+		}
+	}
+}
+
+// TestWriteJSON tests the field names and values of the JSON records
+func TestWriteJSON(t *testing.T) {
+	summary := &batchSummary{
+		results: []fileResult{
+			{input: "a.txt", output: "a.txt.enc", status: statusSucceeded, bytes: 10, duration: 2 * time.Millisecond},
+			{input: "b.txt.enc", status: statusSkipped, err: skipFile("already encrypted")},
+			{input: "c.txt", status: statusFailed, err: fmt.Errorf("c.txt: %w", encryption.ErrCorrupted), bytes: 5},
+		},
+		duration: 3 * time.Millisecond,
+	}
+	var out bytes.Buffer
+	summary.writeJSON(&out)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := [][]string{
+		{"bytes", "duration_ms", "input", "output", "status", "type"},
+		{"bytes", "duration_ms", "input", "reason", "status", "type"},
+		{"bytes", "duration_ms", "error", "error_class", "input", "status", "type"},
+		{"bytes", "duration_ms", "exit_code", "failed", "skipped", "succeeded", "type"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d records, got %d:\n%s", len(want), len(lines), out.String())
+	}
+	records := make([]map[string]any, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatalf("Record %d is not JSON: %v", i, err)
+		}
+		var fields []string
+		for field := range records[i] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, want[i]) {
+			t.Errorf("Record %d: expected fields %v, got %v", i, want[i], fields)
+		}
+	}
+
+	checks := []struct {
+		record int
+		field  string
+		value  any
+	}{
+		{0, "type", "file"},
+		{0, "status", "succeeded"},
+		{0, "output", "a.txt.enc"},
+		{0, "bytes", 10.0},
+		{0, "duration_ms", 2.0},
+		{1, "status", "skipped"},
+		{1, "reason", "already encrypted"},
+		{2, "status", "failed"},
+		{2, "error_class", classCorrupt},
+		{3, "type", "summary"},
+		{3, "succeeded", 1.0},
+		{3, "skipped", 1.0},
+		{3, "failed", 1.0},
+		{3, "bytes", 15.0},
+		{3, "exit_code", float64(exitPartial)},
+	}
+	for _, check := range checks {
+		if value := records[check.record][check.field]; value != check.value {
+			t.Errorf("Record %d: expected %s %v, got %v", check.record, check.field, check.value, value)
+		}
+	}
+
+	// Errors that stop gocrypt before any input are reported in a record of their own
+	out.Reset()
+	writeErrorJSON(&out, errors.New("unknown command"), exitUsage)
+	if got, want := strings.TrimSpace(out.String()), `{"type":"error","error":"unknown command","error_class":"usage","exit_code":2}`; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
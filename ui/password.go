@@ -0,0 +1,165 @@
+package ui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// DefaultPasswordEnv is the environment variable read for the password when stdin carries data
+// and no other password source was chosen.
+const DefaultPasswordEnv = "GOCRYPT_PASSWORD"
+
+// ReadPasswordCLI returns the password from the source chosen with the --password-* flags.
+// Without one it prompts on the terminal, or reads DefaultPasswordEnv when stdin carries data.
+// With --no-password, --recipient or --identity it returns an empty password, as none is needed.
+func ReadPasswordCLI(flags *Flags, stdinIsData bool) (string, error) {
+	sources := 0
+	for _, set := range []bool{flags.PasswordFile != "", flags.PasswordEnv != "", flags.PasswordFD >= 0, flags.PasswordCommand != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", fmt.Errorf("only one of --password-file, --password-env, --password-fd and --password-command can be used")
+	}
+	if flags.Passwordless() {
+		if sources > 0 {
+			return "", fmt.Errorf("--no-password, --recipient and --identity cannot be combined with a --password-* flag")
+		}
+		return "", nil
+	}
+
+	var password string
+	var err error
+	switch {
+	case flags.PasswordFile != "":
+		password, err = passwordFromFile(flags.PasswordFile)
+	case flags.PasswordEnv != "":
+		password, err = passwordFromEnv(flags.PasswordEnv)
+	case flags.PasswordFD >= 0:
+		if flags.PasswordFD == 0 && stdinIsData {
+			return "", fmt.Errorf("--password-fd 0 is stdin, which is used for data")
+		}
+		password, err = passwordFromFD(flags.PasswordFD)
+	case flags.PasswordCommand != "":
+		password, err = passwordFromCommand(flags.PasswordCommand, stdinIsData)
+	case stdinIsData:
+		if password, err = passwordFromEnv(DefaultPasswordEnv); err != nil {
+			return "", fmt.Errorf("stdin is used for data, use a --password-* flag or set %s to provide the password", DefaultPasswordEnv)
+		}
+	default:
+		return PromptPasswordCLI()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(password) == 0 {
+		return "", fmt.Errorf("password cannot be blank")
+	}
+	return password, nil
+}
+
+// ReadNewPasswordCLI returns the password of a new key slot from --new-password-file or
+// --new-password-env, or prompts for it on the terminal. With --new-no-password it returns an empty
+// password, the slot then only needs its --new-keyfile.
+func ReadNewPasswordCLI(flags *Flags) (string, error) {
+	if flags.NewPasswordFile != "" && flags.NewPasswordEnv != "" {
+		return "", fmt.Errorf("only one of --new-password-file and --new-password-env can be used")
+	}
+	if flags.NewNoPassword {
+		if flags.NewKeyfile == "" {
+			return "", fmt.Errorf("--new-no-password needs a --new-keyfile")
+		}
+		if flags.NewPasswordFile != "" || flags.NewPasswordEnv != "" {
+			return "", fmt.Errorf("--new-no-password cannot be combined with a --new-password-* flag")
+		}
+		return "", nil
+	}
+
+	var password string
+	var err error
+	switch {
+	case flags.NewPasswordFile != "":
+		password, err = passwordFromFile(flags.NewPasswordFile)
+	case flags.NewPasswordEnv != "":
+		password, err = passwordFromEnv(flags.NewPasswordEnv)
+	default:
+		fmt.Fprintln(os.Stderr, "Choose the new password.")
+		return PromptPasswordCLI()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(password) == 0 {
+		return "", fmt.Errorf("password cannot be blank")
+	}
+	return password, nil
+}
+
+// passwordFromFile reads the password from the first line of a file.
+func passwordFromFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %v", err)
+	}
+	return firstLine(data), nil
+}
+
+// passwordFromEnv reads the password from an environment variable.
+func passwordFromEnv(name string) (string, error) {
+	password, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return password, nil
+}
+
+// passwordFromFD reads the password from the first line of an open file descriptor, such as one set up with 3<file.
+func passwordFromFD(fd int) (string, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if file == nil {
+		return "", fmt.Errorf("invalid password file descriptor: %d", fd)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password from fd %d: %v", fd, err)
+	}
+	return firstLine(data), nil
+}
+
+// passwordFromCommand runs a helper such as `pass show name` through the shell and reads the
+// password from the first line of its output. The helper may prompt on stderr, and gets stdin
+// unless stdin carries data.
+func passwordFromCommand(command string, stdinIsData bool) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	if !stdinIsData {
+		cmd.Stdin = os.Stdin
+	}
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("password command failed: %v", err)
+	}
+	return firstLine(output), nil
+}
+
+// firstLine returns the data up to the first line break, so trailing newlines and
+// anything a helper prints after the password are not part of it.
+func firstLine(data []byte) string {
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSuffix(line, "\r")
+}
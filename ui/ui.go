@@ -37,7 +37,9 @@ func loadIcon() (fyne.Resource, error) {
 	return iconCache, err
 }
 
-func ShowPasswordPrompt(application fyne.App, action, method, filePath string, onPasswordEntered func(password string, deleteAfter bool)) {
+// ShowPasswordPrompt asks for the password to encrypt or decrypt the files with. A non-empty recoveryCode
+// is shown once while encrypting, and the password is only accepted after the user confirms they saved it.
+func ShowPasswordPrompt(application fyne.App, action, filePath, recoveryCode string, onPasswordEntered func(password string, deleteAfter bool)) {
 	icon, err := loadIcon()
 	if err != nil {
 		fmt.Println(err)
@@ -63,7 +65,22 @@ func ShowPasswordPrompt(application fyne.App, action, method, filePath string, o
 
 	deleteFileAfterEncrypt = widget.NewCheck("Delete original file after encryption", nil)
 	formItems = append(formItems, widget.NewFormItem("", deleteFileAfterEncrypt))
-	
+
+	// The recovery code is not stored anywhere, this is the only time it can be written down
+	var recoverySaved *widget.Check
+	if action == "encrypt" && recoveryCode != "" {
+		codeLabel := widget.NewLabelWithStyle(recoveryCode, fyne.TextAlignLeading, fyne.TextStyle{Monospace: true})
+		copyButton := widget.NewButton("Copy", func() { window.Clipboard().SetContent(recoveryCode) })
+		batchWarning := widget.NewLabel("This one code unlocks every file in this batch without the password.")
+		batchWarning.Wrapping = fyne.TextWrapWord
+		recoverySaved = widget.NewCheck("I saved the recovery code, it will not be shown again", nil)
+		formItems = append(formItems,
+			widget.NewFormItem("Recovery code", container.NewBorder(nil, nil, nil, copyButton, codeLabel)),
+			widget.NewFormItem("", batchWarning),
+			widget.NewFormItem("", recoverySaved),
+		)
+	}
+
 	form := widget.NewForm(formItems...)
 	form.OnSubmit = func() {
 		password := passwordEntry.Text
@@ -75,6 +92,10 @@ func ShowPasswordPrompt(application fyne.App, action, method, filePath string, o
 			dialog.ShowError(errors.New("passwords do not match, please try again"), window)
 			return
 		}
+		if recoverySaved != nil && !recoverySaved.Checked {
+			dialog.ShowError(errors.New("write down the recovery code and confirm you saved it first"), window)
+			return
+		}
 		onPasswordEntered(password, deleteFileAfterEncrypt.Checked)
 		window.Close()
 	}
@@ -136,9 +157,33 @@ func ShowErrorDialog(application fyne.App, message string) {
 
 	// Set the window close function when the dialog is closed
 	dialog.SetOnClosed(func() { window.Close() })
-	
+
 	// Show the dialog and window
 	dialog.Show()
 	window.ShowAndRun()
 }
 
+// ShowInfoDialog displays an informational message in its own window.
+func ShowInfoDialog(application fyne.App, title, message string) {
+	icon, err := loadIcon()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	window := application.NewWindow(title)
+	window.Resize(fyne.NewSize(450, 215))
+	window.CenterOnScreen()
+	window.SetIcon(icon)
+
+	// Wrap the message so long text does not stretch the dialog
+	label := widget.NewLabel(message)
+	label.Wrapping = fyne.TextWrapWord
+
+	dialog := dialog.NewCustom(title, "OK", container.NewVBox(label), window)
+	dialog.Resize(fyne.NewSize(450, 215))
+	dialog.SetOnClosed(func() { window.Close() })
+
+	dialog.Show()
+	window.ShowAndRun()
+}
@@ -3,35 +3,161 @@ package ui
 import (
 	"flag"
 	"fmt"
+	"os"
 	"regexp"
+	"runtime"
 	"strings"
 	"golang.org/x/term"
 	"syscall"
+	"time"
+
+	"GoCrypt/encryption"
 )
 
-// SetupFlags initializes the command-line flags and returns pointers to the flag variables.
-func SetupFlags() (*string, *bool, *int) {
-	outputDir := flag.String("output", "", "Specify the output directory")
-	flag.StringVar(outputDir, "o", "", "Specify the output directory (alias: -o)")
+// Flags holds the values of the command-line flags.
+type Flags struct {
+	OutputDir  string
+	Collision  string // What to do when an output file exists: skip, overwrite or rename
+	NoUI       bool
+	JSON       bool // Print a JSON record per file instead of messages
+	Layers     int
+	Jobs       int           // Files processed at the same time
+	Workers    int           // Chunks of each file processed at the same time, 0 to pick automatically
+	KDFTime    uint          // Argon2id passes
+	KDFMemory  uint          // Argon2id memory in MiB
+	KDFThreads uint          // Argon2id parallelism
+	KDFTarget  time.Duration // Calibrate the KDF to this derivation time instead
+	ChunkSize  uint          // Plaintext sealed into each chunk in KiB
+	Cipher     string        // Cipher used for every layer
+	Cascade    string        // Comma separated ciphers for the layers from the innermost one out, replaces Cipher
+	Format     string        // File format written by encrypt, gocrypt or age
+	Offset     int64         // First plaintext byte printed by cat
+	Length     int64         // Plaintext bytes printed by cat, -1 for the rest of the file
+
+	PasswordFile    string // Read the password from this file
+	PasswordEnv     string // Read the password from this environment variable
+	PasswordFD      int    // Read the password from this file descriptor, -1 if unset
+	PasswordCommand string // Read the password from the output of this command
+	Keyfile         string // Keyfile required next to the password
+	NoPassword      bool   // Use only the keyfile
+	Recovery        bool   // encrypt adds a key slot for a new recovery code
+
+	Recipients []string // Public keys to encrypt to instead of a password
+	Identity   string   // File with the private keys to decrypt with instead of a password
+	X25519     bool     // keygen writes an X25519 key pair instead of a keyfile
+
+	NewPasswordFile string // Read the password of a new key slot from this file
+	NewPasswordEnv  string // Read the password of a new key slot from this environment variable
+	NewKeyfile      string // Keyfile required by a new key slot
+	NewNoPassword   bool   // The new key slot uses only the keyfile
+	Slot            int    // Key slot removed by slots remove, -1 if unset
+
+	Args []string // The command and its files, without the flags
+}
+
+// Passwordless reports whether the flags replace the password, so none should be asked for.
+func (f *Flags) Passwordless() bool {
+	return f.NoPassword || len(f.Recipients) > 0 || f.Identity != ""
+}
+
+// stringList is a flag that can be given several times, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// SetupFlags initializes the command-line flags and returns the parsed values.
+func SetupFlags() *Flags {
+	flags := &Flags{}
+	kdf := encryption.DefaultKDFParams()
+
+	flag.StringVar(&flags.OutputDir, "output", "", "Specify the output directory")
+	flag.StringVar(&flags.OutputDir, "o", "", "Specify the output directory (alias: -o)")
+
+	flag.StringVar(&flags.Collision, "collision", "overwrite", "What to do when an output file already exists: skip, overwrite or rename")
+
+	flag.BoolVar(&flags.NoUI, "no-ui", false, "Disable the GUI")
+	flag.BoolVar(&flags.NoUI, "n", false, "Disable the GUI (alias: -n)")
+
+	flag.BoolVar(&flags.JSON, "json", false, "Print one JSON record per processed file and a summary")
 
-	noUI := flag.Bool("no-ui", false, "Disable the GUI")
-	flag.BoolVar(noUI, "n", false, "Disable the GUI (alias: -n)")
+	flag.IntVar(&flags.Layers, "layers", 5, "Layers of encryption")
+	flag.IntVar(&flags.Layers, "l", 5, "Layers of encryption (alias: -l)")
 
-	layers := flag.Int("layers", 5, "Layers of encryption")
-	flag.IntVar(layers, "l", 5, "Layers of encryption (alias: -l)")
+	flag.IntVar(&flags.Jobs, "jobs", runtime.NumCPU(), "Number of files to process at the same time")
+	flag.IntVar(&flags.Jobs, "j", runtime.NumCPU(), "Number of files to process at the same time (alias: -j)")
 
-	flag.Parse()
+	flag.IntVar(&flags.Workers, "workers", 0, "Number of chunks of each file to encrypt or decrypt at the same time, 0 shares the CPUs between the files")
+
+	flag.UintVar(&flags.KDFTime, "kdf-time", uint(kdf.Time), "Argon2id passes over the memory")
+	flag.UintVar(&flags.KDFMemory, "kdf-memory", uint(kdf.Memory/1024), "Argon2id memory in MiB")
+	flag.UintVar(&flags.KDFThreads, "kdf-threads", uint(kdf.Threads), "Argon2id threads")
+	flag.DurationVar(&flags.KDFTarget, "kdf-target", 0, "Calibrate Argon2id to take this long per key (e.g. 500ms), overrides --kdf-time")
+
+	flag.StringVar(&flags.Cipher, "cipher", encryption.CipherXChaCha20Poly1305, "Cipher used for encryption: "+strings.Join(encryption.Ciphers(), " or "))
+
+	flag.StringVar(&flags.Cascade, "cascade", "", "Comma separated ciphers for the layers from the innermost one out, repeated over all layers (e.g. aes256gcm,xchacha20poly1305)")
+
+	flag.StringVar(&flags.Format, "format", "gocrypt", "File format written by encrypt: gocrypt or age (readable by the age tool, ignores the cipher, layer and KDF settings)")
+
+	flag.Int64Var(&flags.Offset, "offset", 0, "First byte of the plaintext printed by cat")
+	flag.Int64Var(&flags.Length, "length", -1, "Number of plaintext bytes printed by cat, -1 prints the rest of the file")
+
+	flag.UintVar(&flags.ChunkSize, "chunk-size", encryption.DefaultChunkSize/1024, "Plaintext sealed into each chunk in KiB (1-16384)")
+
+	flag.StringVar(&flags.PasswordFile, "password-file", "", "Read the password from the first line of this file")
+	flag.StringVar(&flags.PasswordEnv, "password-env", "", "Read the password from this environment variable")
+	flag.IntVar(&flags.PasswordFD, "password-fd", -1, "Read the password from the first line of this file descriptor")
+	flag.StringVar(&flags.PasswordCommand, "password-command", "", "Run this command and read the password from the first line of its output")
+
+	flag.StringVar(&flags.Keyfile, "keyfile", "", "Require this keyfile in addition to the password, create one with the keygen command")
+	flag.BoolVar(&flags.NoPassword, "no-password", false, "Use only the --keyfile, without a password")
+	flag.BoolVar(&flags.Recovery, "recovery", false, "Add a recovery code that opens the encrypted files without the password, shown once")
+
+	flag.Var((*stringList)(&flags.Recipients), "recipient", "Encrypt to this public key (age1...) instead of a password, can be given several times")
+	flag.StringVar(&flags.Identity, "identity", "", "Decrypt with the private keys in this file instead of a password")
+	flag.BoolVar(&flags.X25519, "x25519", false, "Make keygen write an X25519 key pair for --recipient and --identity")
+
+	flag.StringVar(&flags.NewPasswordFile, "new-password-file", "", "Read the password of a new key slot from the first line of this file")
+	flag.StringVar(&flags.NewPasswordEnv, "new-password-env", "", "Read the password of a new key slot from this environment variable")
+	flag.StringVar(&flags.NewKeyfile, "new-keyfile", "", "Require this keyfile for a new key slot")
+	flag.BoolVar(&flags.NewNoPassword, "new-no-password", false, "Use only the --new-keyfile for a new key slot, without a password")
+	flag.IntVar(&flags.Slot, "slot", -1, "Key slot removed by slots remove, as numbered by slots list")
+
+	// Flags can come before the command, after it and between the files. The flag package stops at
+	// the first other argument, so parsing resumes after each one until "--" or the end.
+	args := os.Args[1:]
+	for {
+		flag.CommandLine.Parse(args)
+		rest := flag.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			flags.Args = append(flags.Args, rest...)
+			break
+		}
+		flags.Args = append(flags.Args, rest[0])
+		args = rest[1:]
+	}
 
-	return outputDir, noUI, layers
+	return flags
 }
 
 // PromptPasswordCLI handles secure password input for CLI mode with validation.
+// Prompts are written to stderr so they never end up in data written to stdout.
 func PromptPasswordCLI() (string, error) {
 	for {
 		// Read password from the terminal securely
-		fmt.Printf("Enter password:")
+		fmt.Fprintf(os.Stderr, "Enter password:")
 		passwordBytes, err := term.ReadPassword(int(syscall.Stdin))
-		fmt.Println() // Newline after password input
+		fmt.Fprintln(os.Stderr) // Newline after password input
 		if err != nil {
 			return "", err
 		}
@@ -39,7 +165,7 @@ func PromptPasswordCLI() (string, error) {
 		password := string(passwordBytes)
 
 		if len(password) == 0 {
-			fmt.Println("Password cannot be blank!")
+			fmt.Fprintln(os.Stderr, "Password cannot be blank!")
 			continue // Re-prompt the user for a new password
 		}
 
@@ -47,9 +173,9 @@ func PromptPasswordCLI() (string, error) {
 		if err := validatePassword(password); err != nil {
 			// If the password is invalid, ask if the user wants to force a weak password
 			for {
-				fmt.Print("This is a weak password. Do you want to use it anyway? (y/n): ")
+				fmt.Fprint(os.Stderr, "This is a weak password. Do you want to use it anyway? (y/n): ")
 				choice, errormsg := term.ReadPassword(int(syscall.Stdin))
-				fmt.Println()
+				fmt.Fprintln(os.Stderr)
 				if errormsg != nil {
 					return "", errormsg
 				}
@@ -58,23 +184,23 @@ func PromptPasswordCLI() (string, error) {
 
 				// Check if the user entered 'y' or 'n'
 				if choiceStr == "y" {
-					fmt.Println("Warning: You are using a weak password.")
+					fmt.Fprintln(os.Stderr, "Warning: You are using a weak password.")
 					break // Exit the loop and proceed with the weak password
 				} else if choiceStr == "n" {
-					fmt.Printf("Reason: %v\n", err)
-					fmt.Println("Please try again. (ctrl+c to exit)")
+					fmt.Fprintf(os.Stderr, "Reason: %v\n", err)
+					fmt.Fprintln(os.Stderr, "Please try again. (ctrl+c to exit)")
 					continue // Exit the inner loop and re-prompt for a new password
 				} else {
 					// Invalid input, re-prompt for a valid choice
-					fmt.Println("Invalid input. Please enter 'y' or 'n'.")
+					fmt.Fprintln(os.Stderr, "Invalid input. Please enter 'y' or 'n'.")
 				} 
 			}
 		}
 
 		// Ask for password confirmation
-		fmt.Printf("Confirm password: ")
+		fmt.Fprintf(os.Stderr, "Confirm password: ")
 		confirmPasswordBytes, err := term.ReadPassword(int(syscall.Stdin))
-		fmt.Println()
+		fmt.Fprintln(os.Stderr)
 		if err != nil {
 			return "", err
 		}
@@ -83,7 +209,7 @@ func PromptPasswordCLI() (string, error) {
 
 		// Check if the passwords match
 		if password != confirmPassword {
-			fmt.Println("Passwords do not match, please try again.")
+			fmt.Fprintln(os.Stderr, "Passwords do not match, please try again.")
 			return "", fmt.Errorf("passwords do not match")
 		}
 